@@ -100,7 +100,7 @@ func (cc *ClientCase) Start() error {
 	defer old.Close()
 
 	n := optPackets / 2
-	originConn := scp.Client(old, nil)
+	originConn := scp.Client(old, &scp.Config{Token: optToken})
 	if err = cc.testN(originConn, n); err != nil {
 		return err
 	}
@@ -169,6 +169,7 @@ func testN(addr string) {
 
 var optConcurrent, optPackets, optMinPacket, optMaxPacket int
 var optVerbose bool
+var optToken string
 var network string
 var fecData, fecParity int
 
@@ -183,6 +184,7 @@ func main() {
 	flag.StringVar(&echoServer, "startEchoServer", "", "start echo server")
 	flag.StringVar(&sconServer, "sconServer", "127.0.0.1:1248", "connect to scon server")
 	flag.BoolVar(&optVerbose, "verbose", false, "verbose")
+	flag.StringVar(&optToken, "token", "", "token of new connections")
 	kcp := flag.NewFlagSet("kcp", flag.ExitOnError)
 	kcp.IntVar(&fecData, "fec_data", 1, "FEC: number of shards to split the data into")
 	kcp.IntVar(&fecParity, "fec_parity", 0, "FEC: number of parity shards")
@@ -6,289 +6,496 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"flag"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
 	"os/signal"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ejoy/goscon/scp"
+	"github.com/ejoy/goscon/server"
 )
 
-var errNoHost = errors.New("no host")
-
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %s [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s [options]\n       %s probe [probe options]\n", os.Args[0], os.Args[0])
 	flag.PrintDefaults()
 	os.Exit(1)
 }
 
-type Host struct {
-	Addr   string `json:"addr"`
-	Weight int    `json:"weight"`
-	Name   string `json:"name"`
-
-	addr *net.TCPAddr
-}
-
-type Config struct {
-	Hosts []Host `json:"hosts"`
-}
-
-type LocalConnWrapper interface {
-	Wrapper(local *net.TCPConn, remote net.Conn) (*net.TCPConn, error)
-}
-
-type LocalConnProvider struct {
-	sync.Mutex
-	hosts  []Host
-	weight int
-
-	wrapper LocalConnWrapper
-
-	ConfigFile string
-}
-
-func (tp *LocalConnProvider) MustSetWrapper(wrapper LocalConnWrapper) {
-	if tp.wrapper != nil {
-		panic("tp.wrapper != nil")
-	}
-	tp.wrapper = wrapper
-}
-
-func (tp *LocalConnProvider) GetHostByWeight() *Host {
-	v := rand.Intn(tp.weight)
-	for _, host := range tp.hosts {
-		if host.Weight >= v {
-			return &host
-		}
-		v -= host.Weight
-	}
-	return nil
-}
-
-func (tp *LocalConnProvider) GetHostByName(name string) *Host {
-	for _, host := range tp.hosts {
-		if host.Name == name {
-			return &host
-		}
-	}
-	Log("GetHostByName failed: %s", name)
-	return nil
-}
-
-func (tp *LocalConnProvider) GetHost(preferred string) *Host {
-	if preferred == "" {
-		return tp.GetHostByWeight()
-	} else {
-		return tp.GetHostByName(preferred)
-	}
-}
-
-func (tp *LocalConnProvider) CreateLocalConn(remoteConn *scp.Conn) (*net.TCPConn, error) {
-	host := glbLocalConnProvider.GetHost(remoteConn.TargetServer())
-	if host == nil {
-		return nil, errNoHost
-	}
-
-	conn, err := net.DialTCP("tcp", nil, host.addr)
-	if err != nil {
-		return nil, err
-	}
-
-	if tp.wrapper == nil {
-		return conn, err
-	}
-
-	newConn, err := tp.wrapper.Wrapper(conn, remoteConn)
-	if err != nil {
-		conn.Close()
-		return nil, err
-	}
-
-	return newConn, nil
-}
-
-func (tp *LocalConnProvider) reset(hosts []Host) error {
-	var weight int
-	for i := range hosts {
-		host := &hosts[i]
-		if addr, err := net.ResolveTCPAddr("tcp", host.Addr); err != nil {
-			return err
-		} else {
-			host.addr = addr
-		}
-		weight += host.Weight
-	}
-
-	if weight <= 0 {
-		return fmt.Errorf("no hosts")
-	}
-
-	tp.Lock()
-	tp.hosts = hosts
-	tp.weight = weight
-	tp.Unlock()
-	return nil
-}
-
-func (tp *LocalConnProvider) Reload() error {
-	fp, err := os.Open(tp.ConfigFile)
-	if err != nil {
-		return err
-	}
-	defer fp.Close()
-
-	var config Config
-	dec := json.NewDecoder(fp)
-	err = dec.Decode(&config)
-	if err != nil {
-		return err
-	}
-
-	return tp.reset(config.Hosts)
-}
-
 const SIG_RELOAD = syscall.Signal(34)
 const SIG_STATUS = syscall.Signal(35)
 
-func reload() {
-	err := glbLocalConnProvider.Reload()
+func reload(ss *server.SCPServer) {
+	err := ss.Reload()
 	if err != nil {
-		Log("reload failed: %s", err.Error())
+		server.Log("reload failed: %s", err.Error())
 		return
 	}
-	Log("reload succeed")
+	server.Log("reload succeed")
 }
 
-func status() {
-	Log("status:\n\t"+
+func status(ss *server.SCPServer) {
+	r := ss.Status()
+	server.Log("status:\n\t"+
+		"instance:%s\n\t"+
 		"procs:%d/%d\n\t"+
 		"goroutines:%d\n\t"+
-		"actives:%d",
-		runtime.GOMAXPROCS(0), runtime.NumCPU(),
-		runtime.NumGoroutine(),
-		glbScpServer.NumOfConnPairs())
+		"actives:%d/%d\n\t"+
+		"sessions by host:%v, reuses:%d, dial failures:%d\n\t"+
+		"draining:%v\n\t"+
+		"goroutine rejected:%d\n\t"+
+		"conns rejected:%d\n\t"+
+		"idle reaped:%d\n\t"+
+		"acl denied:%d, token rejected:%d\n\t"+
+		"client rejected:%d\n\t"+
+		"client list:%d, evicted:%d, refused:%d\n\t"+
+		"events dropped:%d\n\t"+
+		"sent cache:%v\n\t"+
+		"family mismatches:%d\n\t"+
+		"flapping sessions:%d\n\t"+
+		"cross ip reconnections rejected:%d\n\t"+
+		"handshake retries:%d\n\t"+
+		"relay samples:%v\n\t"+
+		"accept queue:%d, delayed:%v, rejected:%d\n\t"+
+		"dial failure ratios:%v\n\t"+
+		"health:%v\n\t"+
+		"hosts rejected:%d\n\t"+
+		"dial retries:%d\n\t"+
+		"rate limited:%d, limited ips:%d, evicted:%d, refused:%d\n\t"+
+		"pool hits:%d",
+		r.Instance,
+		r.GOMAXPROCS, r.CPUs,
+		r.Goroutines,
+		r.ConnPairs, r.MaxConns,
+		r.Pairs.ByHost, r.Pairs.Reuses, r.Pairs.DialFailures,
+		r.Draining,
+		r.GoroutineRejected,
+		r.ConnsRejected,
+		r.IdleReaped,
+		r.ACLDenied, r.TokenRejected,
+		r.ClientRejected,
+		r.ClientList, r.ClientEvicted, r.ClientRefused,
+		r.EventsDropped,
+		r.SentCache,
+		r.FamilyMismatches,
+		r.FlappingSessions,
+		r.CrossIPRejected,
+		r.HandshakeRetries,
+		r.RelaySamples,
+		r.AcceptQueue, r.AcceptDelayed, r.AcceptRejected,
+		r.DialFailureRatios,
+		r.Health,
+		r.HostsRejected,
+		r.DialRetries,
+		r.RateLimited, r.LimitedIPs, r.LimitedIPsEvicted, r.LimitedIPsRefused,
+		r.PoolHits)
 }
 
-func handleSignal() {
+func handleSignal(ss *server.SCPServer, drainTimeout time.Duration) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, SIG_RELOAD, SIG_STATUS, syscall.SIGTERM)
+	signal.Notify(c, SIG_RELOAD, SIG_STATUS, syscall.SIGTERM, syscall.SIGINT)
 
 	for sig := range c {
 		switch sig {
 		case SIG_RELOAD:
-			reload()
+			reload(ss)
 		case SIG_STATUS:
-			status()
-		case syscall.SIGTERM:
-			Log("catch sigterm, ignore")
+			status(ss)
+		case syscall.SIGTERM, syscall.SIGINT:
+			server.Log("catch %v, drain, timeout %v", sig, drainTimeout)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+				defer cancel()
+				ss.Shutdown(ctx)
+			}()
 		}
 	}
 }
 
-var glbScpServer *SCPServer
-var glbLocalConnProvider *LocalConnProvider
-
-var optUploadMinPacket, optUploadMaxDelay int
-
-var glbWrapperHooks []func(provider *LocalConnProvider)
+var glbWrapperHooks []func(provider *server.LocalConnProvider)
 
-func installWrapperHook(hook func(provider *LocalConnProvider)) {
+func installWrapperHook(hook func(provider *server.LocalConnProvider)) {
 	glbWrapperHooks = append(glbWrapperHooks, hook)
 }
 
-func wrapperHook(provider *LocalConnProvider) {
+func wrapperHook(provider *server.LocalConnProvider) {
 	for _, hook := range glbWrapperHooks {
 		hook(provider)
 	}
 }
 
+var glbServerHooks []func(ss *server.SCPServer)
+
+func installServerHook(hook func(ss *server.SCPServer)) {
+	glbServerHooks = append(glbServerHooks, hook)
+}
+
+func serverHook(ss *server.SCPServer) {
+	for _, hook := range glbServerHooks {
+		hook(ss)
+	}
+}
+
 type OptionsFlag struct {
 	set       bool
 	fecData   int
 	fecParity int
+
+	server.TransportOptions
+	tuning server.KCPOptions
 }
 
 func (o *OptionsFlag) String() string {
 	return fmt.Sprint(*o)
 }
 
+// Set parses comma separated key:value options, unknown keys are refused
 func (o *OptionsFlag) Set(value string) error {
 	o.set = true
 	pairs := strings.Split(value, ",")
 	for _, pair := range pairs {
-		option := strings.Split(pair, ":")
+		if pair == "" {
+			continue
+		}
+		option := strings.SplitN(pair, ":", 2)
+		if len(option) != 2 {
+			return fmt.Errorf("invalid option %s, expected key:value", pair)
+		}
+		if option[0] == "iface" {
+			if _, err := net.InterfaceByName(option[1]); err != nil {
+				return fmt.Errorf("invalid iface %s: %s", option[1], err.Error())
+			}
+			o.Iface = option[1]
+			continue
+		}
+
+		var v *int
+		max := -1 // no upper bound
 		switch option[0] {
 		case "fec_data":
-			data, err := strconv.Atoi(option[1])
-			if err != nil {
-				return err
-			}
-			o.fecData = data
+			v = &o.fecData
 		case "fec_parity":
-			parity, err := strconv.Atoi(option[1])
-			if err != nil {
-				return err
-			}
-			o.fecParity = parity
+			v = &o.fecParity
+		case "sbuf":
+			v = &o.SentCacheSize
+		case "dscp":
+			v, max = &o.DSCP, 63
+		case "nodelay":
+			v, max = &o.tuning.NoDelay, 1
+		case "interval":
+			v = &o.tuning.Interval
+		case "resend":
+			v = &o.tuning.Resend
+		case "nc":
+			v, max = &o.tuning.NC, 1
+		case "sndwnd":
+			v = &o.tuning.SndWnd
+		case "rcvwnd":
+			v = &o.tuning.RcvWnd
+		case "mtu":
+			v, max = &o.tuning.MTU, server.KCPMaxMTU
+		default:
+			return fmt.Errorf("unknown option %s", option[0])
+		}
+		n, err := strconv.Atoi(option[1])
+		if err != nil || n < 0 || (max >= 0 && n > max) {
+			return fmt.Errorf("invalid %s: %s", option[0], option[1])
 		}
+		*v = n
 	}
 	return nil
 }
 
+// runCheckConfig validates the config file of provider, prints every problem
+// and returns the exit code
+func runCheckConfig(provider *server.LocalConnProvider) int {
+	err := provider.Check()
+	if err == nil {
+		fmt.Printf("config %s ok\n", provider.ConfigFile)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "config %s invalid:\n", provider.ConfigFile)
+	if e, ok := err.(*server.ConfigError); ok {
+		for _, problem := range e.Problems {
+			fmt.Fprintf(os.Stderr, "\t%s\n", problem)
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "\t%s\n", err.Error())
+	}
+	return 1
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		os.Exit(runProbe(os.Args[2:]))
+	}
+
 	// deal with arguments
 	var tcp OptionsFlag
 	var kcp OptionsFlag
 	var config string
+	var checkConfig bool
 	var listen string
 	var reuseTimeout int
 	var sentCacheSize int
-
-	flag.Var(&tcp, "tcp", "listen for tcp port")
-	flag.Var(&kcp, "kcp", "listen for kcp port default (default \"fec_data:0,fec_parity:0\")")
+	var sentCacheMin, sentCacheMax int
+	var maxGoroutines int
+	var maxConns int
+	var control string
+	var warmup bool
+	var writeTimeout int
+	var idleTimeout int
+	var reconnectWarn int
+	var sampleInterval int
+	var backendDSCP int
+	var globalAcceptRate int
+	var globalAcceptMaxDelay int
+	var dialWindow int
+	var warmPool int
+	var maxHosts int
+	var maxFrame int
+	var oversized string
+	var instance string
+	var reconnectIP string
+	var acceptLoops int
+	var drainTimeout int
+	var ipTableSize int
+	var ipTablePolicy string
+	var handshakeTimeout int
+	var handshakeRetries int
+	var propagate string
+	var acceptAffinity bool
+	var reconnectSubnet int
+	var reconnectSubnet6 int
+	var enableMetrics bool
+	var uploadMinPacket int
+	var uploadMaxDelay int
+	var logLevel int
+	var logFormat string
+	var proxyProtocol string
+
+	flag.Var(&tcp, "tcp", "listen for tcp port, options: sbuf, dscp, iface")
+	flag.Var(&kcp, "kcp", "listen for kcp port default (default \"fec_data:0,fec_parity:0\"), options: fec_data, fec_parity, sbuf, dscp, iface, nodelay, interval, resend, nc, sndwnd, rcvwnd, mtu")
 	flag.StringVar(&config, "config", "./settings.conf", "backend servers config file")
-	flag.StringVar(&listen, "listen", "0.0.0.0:1248", "local listen port(0.0.0.0:1248)")
+	flag.BoolVar(&checkConfig, "checkConfig", false, "validate the config file and exit, non-zero if invalid")
+	flag.StringVar(&listen, "listen", "0.0.0.0:1248", "local listen addresses, comma separated(0.0.0.0:1248)")
 	flag.IntVar(&logLevel, "log", 2, "larger value for detail log")
+	flag.StringVar(&logFormat, "logFormat", server.LogFormatText, "log format, text or json with session context")
 	flag.IntVar(&reuseTimeout, "timeout", 30, "reuse timeout")
-	flag.IntVar(&sentCacheSize, "sbuf", 65536, "sent cache size")
-	flag.IntVar(&optUploadMinPacket, "uploadMinPacket", 0, "upload minimal packet")
-	flag.IntVar(&optUploadMaxDelay, "uploadMaxDelay", 0, "upload maximal delay milliseconds")
+	flag.IntVar(&writeTimeout, "writeTimeout", 0, "close session if a relay write blocks longer than this seconds, 0 means no timeout")
+	flag.IntVar(&idleTimeout, "idleTimeout", 0, "close session if no bytes relayed in either direction for this seconds, sessions waiting for reuse are not counted, 0 means no timeout")
+	flag.IntVar(&maxFrame, "maxFrame", 16*1024, "max bytes of a frame, which is one relay write of what a read from the peer returned, up to 32KB, 0 means unlimited")
+	flag.StringVar(&oversized, "oversized", "split", "policy for frames larger than maxFrame: split into writes of maxFrame bytes, or close the session")
+	flag.IntVar(&reconnectWarn, "reconnectWarn", 0, "log sessions reconnected this many times, 0 means disabled")
+	flag.IntVar(&sampleInterval, "sampleInterval", 0, "sample relay states every this milliseconds, 0 means disabled")
+	flag.IntVar(&sentCacheSize, "sbuf", 65536, "sent cache size, overridden by sbuf option of -tcp/-kcp")
+	flag.IntVar(&sentCacheMin, "sbufMin", 4096, "min sent cache size granted to client requests")
+	flag.IntVar(&sentCacheMax, "sbufMax", 0, "max sent cache size granted to client requests, 0 means requests are ignored")
+	flag.IntVar(&uploadMinPacket, "uploadMinPacket", 0, "upload minimal packet, overridden by upload_min_packet of hosts")
+	flag.IntVar(&uploadMaxDelay, "uploadMaxDelay", 0, "upload maximal delay milliseconds, overridden by upload_max_delay of hosts")
+	flag.StringVar(&control, "control", "", "control http server address, e.g. 127.0.0.1:6060, disabled if empty")
+	flag.BoolVar(&enableMetrics, "metrics", false, "serve prometheus metrics on /metrics of the control server")
+	flag.IntVar(&backendDSCP, "backendDscp", 0, "dscp of backend connections, 0 means os default")
+	flag.IntVar(&dialWindow, "dialWindow", 100, "number of recent dials per host for dial failure ratio")
+	flag.IntVar(&maxHosts, "maxHosts", 10000, "refuse config with more backend hosts, 0 means no limit")
+	flag.IntVar(&warmPool, "warmPool", 0, "pre-dialed backend connections kept for every host, 0 means disabled")
+	flag.BoolVar(&warmup, "warmup", false, "pre-dial backend hosts at startup and after reload")
+	flag.IntVar(&globalAcceptRate, "globalAcceptRate", 0, "new sessions admitted per second, bursts are delayed, 0 means unlimited")
+	flag.IntVar(&globalAcceptMaxDelay, "globalAcceptMaxDelay", 1000, "milliseconds a new session may be delayed by globalAcceptRate, sessions of longer delays are rejected")
+	flag.IntVar(&maxConns, "maxConns", 0, "refuse new sessions when sessions reach this, reconnections are not counted, 0 means no limit")
+	flag.IntVar(&maxGoroutines, "maxGoroutines", 0, "refuse new connections when goroutines exceed this, 0 means no limit")
+
+	flag.StringVar(&reconnectIP, "reconnectIP", server.ReconnectIPAny, "source ips allowed to reconnect a session: any, same or subnet")
+	flag.IntVar(&reconnectSubnet, "reconnectSubnet", 24, "ipv4 prefix length of subnet for -reconnectIP subnet")
+	flag.IntVar(&reconnectSubnet6, "reconnectSubnet6", 64, "ipv6 prefix length of subnet for -reconnectIP subnet")
+	flag.IntVar(&handshakeTimeout, "handshakeTimeout", 0, "timeout seconds of each handshake read, 0 means no timeout")
+	flag.IntVar(&handshakeRetries, "handshakeRetries", 0, "retries of handshake reads failed by timeout or temporary errors, 0 means no retry")
+	flag.IntVar(&ipTableSize, "ipTableSize", 65536, "max entries of per ip state such as the client list and every rate limited name, 0 means unlimited")
+	flag.StringVar(&ipTablePolicy, "ipTablePolicy", server.IPTableOpen, "when per ip state is full: open evicts least recently used entries, closed refuses new entries")
+	flag.IntVar(&drainTimeout, "drainTimeout", 30, "seconds to wait for sessions on SIGTERM/SIGINT before closing them")
+	flag.IntVar(&acceptLoops, "acceptLoops", 1, "accept loops per listener, each on its own reuseport socket where supported")
+	flag.BoolVar(&acceptAffinity, "acceptAffinity", false, "bind accept loops to cpus")
+	flag.StringVar(&proxyProtocol, "proxyProtocol", server.ProxyProtocolOff, "PROXY protocol header sent to backends with the client address: off, v1 or v2")
+	flag.StringVar(&propagate, "propagate", "", "client tcp socket parameters applied on backend connections, comma separated: rcvbuf, sndbuf, nodelay")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&instance, "instance", hostname, "instance id prefixed to session ids, unique across instances")
 
 	flag.Usage = usage
 	flag.Parse()
+	server.SetLogLevel(logLevel)
+	if err := server.SetLogFormat(logFormat); err != nil {
+		server.Error("%s", err.Error())
+		return
+	}
 
-	glbLocalConnProvider = new(LocalConnProvider)
-	glbLocalConnProvider.ConfigFile = config
-	Info("config file: %s", glbLocalConnProvider.ConfigFile)
+	if maxFrame < 0 || maxFrame > scp.NetBufferSize {
+		server.Error("invalid maxFrame: %d, relay reads are up to %d bytes", maxFrame, scp.NetBufferSize)
+		return
+	}
 
-	if err := glbLocalConnProvider.Reload(); err != nil {
-		Error("load target pool failed: %s", err.Error())
+	if oversized != "split" && oversized != "close" {
+		server.Error("invalid oversized policy: %s", oversized)
 		return
 	}
 
-	wrapperHook(glbLocalConnProvider)
+	if sentCacheMin < 1 || sentCacheMax < 0 || sentCacheMax > scp.MaxSentCacheRequest ||
+		(sentCacheMax > 0 && sentCacheMax < sentCacheMin) {
+		server.Error("invalid sbufMin/sbufMax: %d/%d", sentCacheMin, sentCacheMax)
+		return
+	}
+
+	if globalAcceptMaxDelay < 0 {
+		server.Error("invalid globalAcceptMaxDelay: %d", globalAcceptMaxDelay)
+		return
+	}
+
+	if dialWindow < 1 {
+		server.Error("invalid dialWindow: %d", dialWindow)
+		return
+	}
+
+	if ipTablePolicy != server.IPTableOpen && ipTablePolicy != server.IPTableClosed {
+		server.Error("invalid ipTablePolicy: %s", ipTablePolicy)
+		return
+	}
+
+	laddrs, err := parseListen(listen)
+	if err != nil {
+		server.Error("invalid listen: %s", err.Error())
+		return
+	}
+
+	if acceptLoops < 1 {
+		server.Error("invalid acceptLoops: %d", acceptLoops)
+		return
+	}
+
+	switch reconnectIP {
+	case server.ReconnectIPAny, server.ReconnectIPSame:
+	case server.ReconnectIPSubnet:
+		if reconnectSubnet < 0 || reconnectSubnet > 32 || reconnectSubnet6 < 0 || reconnectSubnet6 > 128 {
+			server.Error("invalid reconnect subnet: %d, %d", reconnectSubnet, reconnectSubnet6)
+			return
+		}
+	default:
+		server.Error("invalid reconnectIP policy: %s", reconnectIP)
+		return
+	}
+
+	if !server.BindDeviceSupported && (tcp.Iface != "" || kcp.Iface != "") {
+		server.Error("iface: %s", server.ErrBindDeviceUnsupported.Error())
+		return
+	}
+
+	switch proxyProtocol {
+	case server.ProxyProtocolOff, server.ProxyProtocolV1, server.ProxyProtocolV2:
+	default:
+		server.Error("invalid proxyProtocol: %s", proxyProtocol)
+		return
+	}
+
+	propagateMask, err := server.ParsePropagate(propagate)
+	if err != nil {
+		server.Error("invalid propagate: %s", err.Error())
+		return
+	}
+	if !server.SockParamsSupported && propagateMask != 0 {
+		server.Log("warning: socket parameters unsupported on this platform, propagate ignored")
+		propagateMask = 0
+	}
+
+	if backendDSCP < 0 || backendDSCP > 63 {
+		server.Error("invalid backendDscp: %d", backendDSCP)
+		return
+	}
+	if !server.DSCPSupported && (backendDSCP > 0 || tcp.DSCP > 0) {
+		server.Log("warning: dscp unsupported on this platform, ignored")
+		backendDSCP = 0
+		tcp.DSCP = 0
+	}
+
+	if enableMetrics && control == "" {
+		server.Error("metrics requires control server")
+		return
+	}
+
+	provider := server.NewLocalConnProvider(config)
+	provider.Warmup = warmup
+	provider.DSCP = backendDSCP
+	provider.DialWindow = dialWindow
+	provider.MaxHosts = maxHosts
+	provider.WarmPool = warmPool
+	provider.Propagate = propagateMask
+	provider.ProxyProtocol = proxyProtocol
+	provider.IPTableSize = ipTableSize
+	provider.IPTablePolicy = ipTablePolicy
+	server.Info("config file: %s", provider.ConfigFile)
+
+	if checkConfig {
+		os.Exit(runCheckConfig(provider))
+	}
+
+	if err := provider.Reload(); err != nil {
+		server.Error("load target pool failed: %s", err.Error())
+		return
+	}
+
+	wrapperHook(provider)
 
 	if sentCacheSize > 0 {
 		scp.SentCacheSize = sentCacheSize
 	}
 
-	go handleSignal()
+	ss := server.NewServer(&server.Options{
+		Timeout:          reuseTimeout,
+		FecData:          kcp.fecData,
+		FecParity:        kcp.fecParity,
+		MaxGoroutines:    maxGoroutines,
+		MaxConns:         maxConns,
+		WriteTimeout:     writeTimeout,
+		IdleTimeout:      idleTimeout,
+		SentCacheMin:     sentCacheMin,
+		SentCacheMax:     sentCacheMax,
+		MaxFrame:         maxFrame,
+		SplitFrame:       oversized == "split",
+		ReconnectWarn:    reconnectWarn,
+		SampleInterval:   sampleInterval,
+		UploadMinPacket:  uploadMinPacket,
+		UploadMaxDelay:   uploadMaxDelay,
+		GlobalAcceptRate: globalAcceptRate,
+		AcceptMaxDelay:   globalAcceptMaxDelay,
+		Instance:         instance,
+		AcceptLoops:      acceptLoops,
+		IPTableSize:      ipTableSize,
+		IPTablePolicy:    ipTablePolicy,
+		HandshakeTimeout: handshakeTimeout,
+		HandshakeRetries: handshakeRetries,
+		AcceptAffinity:   acceptAffinity,
+		ReconnectIP:      reconnectIP,
+		ReconnectSubnet:  reconnectSubnet,
+		ReconnectSubnet6: reconnectSubnet6,
+		Metrics:          enableMetrics,
+		TCP:              tcp.TransportOptions,
+		KCP:              kcp.TransportOptions,
+		KCPTuning:        kcp.tuning,
+	}, provider)
+
+	go handleSignal(ss, time.Duration(drainTimeout)*time.Second)
+
+	if control != "" {
+		if err := ss.StartControl(control); err != nil {
+			server.Error("start control server failed: %s", err.Error())
+			return
+		}
+	}
 
-	glbScpServer = NewSCPServer(&Options{
-		timeout:   reuseTimeout,
-		fecData:   kcp.fecData,
-		fecParity: kcp.fecParity,
-	})
+	serverHook(ss)
 
 	var wg sync.WaitGroup
 
@@ -296,22 +503,44 @@ func main() {
 		tcp.set = true
 	}
 
-	Log("tcp = %v", tcp)
-	Log("kcp = %v", kcp)
+	server.Log("tcp = %v", tcp)
+	server.Log("kcp = %v", kcp)
 
-	if tcp.set {
+	start := func(network, laddr string) {
 		wg.Add(1)
 		go func() {
-			glbScpServer.Start("tcp", listen)
+			if err := ss.Start(network, laddr); err != nil {
+				server.Error("%s listen on %s failed: %s", network, laddr, err.Error())
+			}
 			wg.Done()
 		}()
 	}
-	if kcp.set {
-		wg.Add(1)
-		go func() {
-			glbScpServer.Start("kcp", listen)
-			wg.Done()
-		}()
+	for _, laddr := range laddrs {
+		if tcp.set {
+			start("tcp", laddr)
+		}
+		if kcp.set {
+			start("kcp", laddr)
+		}
 	}
 	wg.Wait()
 }
+
+// parseListen splits comma separated listen addresses, duplicates are refused
+func parseListen(listen string) ([]string, error) {
+	var laddrs []string
+	seen := make(map[string]bool)
+	for _, laddr := range strings.Split(listen, ",") {
+		laddr = strings.TrimSpace(laddr)
+		addr, err := net.ResolveTCPAddr("tcp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		if seen[addr.String()] {
+			return nil, fmt.Errorf("duplicate address %s", laddr)
+		}
+		seen[addr.String()] = true
+		laddrs = append(laddrs, laddr)
+	}
+	return laddrs, nil
+}
@@ -0,0 +1,49 @@
+// +build nats
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+
+	"github.com/ejoy/goscon/server"
+	"github.com/nats-io/nats.go"
+)
+
+var optNatsURL string
+var optNatsSubject string
+var optNatsBuffer int
+
+// publishEvents publishes session events to nats, events are dropped by
+// the hub if the buffer is full so the relay never blocks on nats
+func publishEvents(nc *nats.Conn, ch chan *server.SessionEvent) {
+	for e := range ch {
+		data, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		if err := nc.Publish(optNatsSubject, data); err != nil {
+			server.Error("nats publish failed: %s", err.Error())
+		}
+	}
+}
+
+func natsServerHook(ss *server.SCPServer) {
+	if optNatsURL == "" {
+		return
+	}
+	nc, err := nats.Connect(optNatsURL, nats.Name("goscon"), nats.MaxReconnects(-1))
+	if err != nil {
+		server.Error("connect nats %s failed: %s", optNatsURL, err.Error())
+		return
+	}
+	server.Info("publish session events to nats %s, subject: %s", optNatsURL, optNatsSubject)
+	go publishEvents(nc, ss.Subscribe(optNatsBuffer))
+}
+
+func init() {
+	flag.StringVar(&optNatsURL, "nats", "", "publish session events to nats url, disabled if empty")
+	flag.StringVar(&optNatsSubject, "natsSubject", "goscon.session", "nats subject of session events")
+	flag.IntVar(&optNatsBuffer, "natsBuffer", 1024, "session events buffered for nats, overflowed events are dropped")
+	installServerHook(natsServerHook)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+	"github.com/ejoy/goscon/server"
+)
+
+const probeEventBuffer = 64
+
+// runProbe implements `goscon probe`, it opens a single scp session to a backend,
+// reports each step with timing and exits non-zero on failure.
+// Without -server an instance is started in process on loopback, so selection
+// and dial of the config are reported as well.
+func runProbe(args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	serverAddr := fs.String("server", "", "address of the running instance, start one in process with -config if empty")
+	config := fs.String("config", "./settings.conf", "backend servers config file, without -server")
+	target := fs.String("target", "", "name of the backend host, selected by weight if empty")
+	echo := fs.String("echo", "ping", "payload expected to be echoed by the backend, no round trip if empty")
+	timeout := fs.Int("timeout", 5, "timeout of each step in seconds")
+	fs.Parse(args)
+
+	p := &prober{
+		target:  *target,
+		echo:    []byte(*echo),
+		timeout: time.Duration(*timeout) * time.Second,
+	}
+	addr := *serverAddr
+	if addr == "" {
+		var err error
+		if addr, err = p.startLocal(*config); err != nil {
+			p.step("start", err)
+			return 1
+		}
+	}
+	fmt.Printf("probe %s via %s\n", p.targetName(), addr)
+	if err := p.run(addr); err != nil {
+		return 1
+	}
+	return 0
+}
+
+type prober struct {
+	target  string
+	echo    []byte
+	timeout time.Duration
+	events  chan *server.SessionEvent // nil unless the instance is in process
+
+	provider *server.LocalConnProvider // of the in process instance
+
+	start time.Time
+	last  time.Time
+}
+
+func (p *prober) targetName() string {
+	if p.target == "" {
+		return "(by weight)"
+	}
+	return p.target
+}
+
+// step prints result and time of a step
+func (p *prober) step(name string, err error, detail ...interface{}) {
+	now := time.Now()
+	elapsed := now.Sub(p.last)
+	p.last = now
+	if err != nil {
+		fmt.Printf("  %-10s FAIL %v (%v)\n", name, err, elapsed)
+		return
+	}
+	fmt.Printf("  %-10s ok %s (%v)\n", name, fmt.Sprint(detail...), elapsed)
+}
+
+// startLocal loads config and serves scp on a loopback port in process
+func (p *prober) startLocal(config string) (string, error) {
+	p.provider = server.NewLocalConnProvider(config)
+	p.provider.DialWindow = 100
+	if err := p.provider.Reload(); err != nil {
+		return "", err
+	}
+	wrapperHook(p.provider)
+
+	options := &server.Options{Timeout: 30}
+	ss := server.NewServer(options, p.provider)
+	p.events = ss.Subscribe(probeEventBuffer)
+
+	ln, err := server.ListenWithOptions("tcp", "127.0.0.1:0", options)
+	if err != nil {
+		return "", err
+	}
+	go ss.Serve("tcp", ln)
+	return ln.Addr().String(), nil
+}
+
+func (p *prober) run(addr string) error {
+	p.start = time.Now()
+	p.last = p.start
+	defer func() {
+		fmt.Printf("  %-10s %v\n", "total", time.Since(p.start))
+	}()
+
+	conn, err := net.DialTimeout("tcp", addr, p.timeout)
+	p.step("connect", err, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	scon := scp.Client(conn, &scp.Config{TargetServer: p.target})
+	scon.SetDeadline(time.Now().Add(p.timeout))
+	err = scon.Handshake()
+	p.step("handshake", err, "id ", scon.ID())
+	if err != nil {
+		return err
+	}
+
+	if p.events != nil {
+		if err = p.waitOpen(scon.ID()); err != nil {
+			return err
+		}
+	}
+
+	if len(p.echo) == 0 {
+		return nil
+	}
+	scon.SetDeadline(time.Now().Add(p.timeout))
+	if _, err = scon.Write(p.echo); err == nil {
+		buf := make([]byte, len(p.echo))
+		if _, err = io.ReadFull(scon, buf); err == nil && !bytes.Equal(buf, p.echo) {
+			err = fmt.Errorf("echo mismatch: %q", buf)
+		}
+	}
+	p.step("echo", err, len(p.echo), " bytes")
+	return err
+}
+
+// waitOpen reports selection and dial of session id by the in process instance
+func (p *prober) waitOpen(id int) error {
+	deadline := time.After(p.timeout)
+	for {
+		select {
+		case e := <-p.events:
+			if e.ID != id {
+				continue
+			}
+			if e.Type == server.EventClose {
+				err := fmt.Errorf("%s", e.Reason)
+				p.step("dial", err)
+				return err
+			}
+			if e.Type == server.EventOpen {
+				host := p.provider.GetHostByName(e.Host)
+				resolved := "?"
+				if host != nil {
+					resolved = host.TCPAddr().String()
+				}
+				p.step("dial", nil, e.Host, " ", resolved)
+				return nil
+			}
+		case <-deadline:
+			err := fmt.Errorf("timeout")
+			p.step("dial", err)
+			return err
+		}
+	}
+}
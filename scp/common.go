@@ -18,6 +18,7 @@ const (
 
 var ErrIllegalMsg = fmt.Errorf("Illegal Message")
 var ErrUnauthorized = fmt.Errorf("401 Unauthorized")
+var ErrTokenMismatch = fmt.Errorf("401 Token Mismatch")
 var ErrIndexExpired = fmt.Errorf("403 Index Expired")
 var ErrIDNotFound = fmt.Errorf("404 ID Not Found")
 var ErrNotAcceptable = fmt.Errorf("406 Not Acceptable")
@@ -129,6 +129,7 @@ type Conn struct {
 	handshakeMutex    sync.Mutex
 	handshakeErr      error
 	handshakeComplete bool
+	handshakeRetries  int // reads retried after temporary errors
 
 	// half conn
 	in  *cipherConnReader
@@ -141,13 +142,18 @@ type Conn struct {
 
 	sentCache *loopBuffer
 
+	peerSentCacheSize int // granted sent cache size of server, 0 if not requested
+
 	reused bool // reused conn
 }
 
-func (c *Conn) initNewConn(id int, secret leu64) {
+func (c *Conn) initNewConn(id int, secret leu64, sentCacheSize int) {
 	c.id = id
 	c.secret = secret
-	c.sentCache = newLoopBuffer(SentCacheSize)
+	if sentCacheSize <= 0 {
+		sentCacheSize = SentCacheSize
+	}
+	c.sentCache = newLoopBuffer(sentCacheSize)
 
 	c.in = newCipherConnReader(c.secret)
 	c.out = newCipherConnWriter(c.secret)
@@ -161,7 +167,9 @@ func (c *Conn) initReuseConn(oldConn *Conn, handshakes int) {
 	c.id = oldConn.id
 	c.handshakes = handshakes
 	c.secret = oldConn.secret
+	c.peerSentCacheSize = oldConn.peerSentCacheSize
 
+	// the cache keeps the size negotiated by the new conn
 	c.sentCache = deepCopyLoopBuffer(oldConn.sentCache)
 	c.in = deepCopyCipherConnReader(oldConn.in)
 	c.out = deepCopyCipherConnWriter(oldConn.out)
@@ -188,20 +196,47 @@ func (c *Conn) writeRecord(msg handshakeMessage) error {
 	return w.Flush()
 }
 
-func (c *Conn) readRecord(msg handshakeMessage) error {
-	var sz uint16
-	if err := binary.Read(c.conn, binary.BigEndian, &sz); err != nil {
-		return err
-	}
+// isRetryable reports whether a handshake read can be attempted again,
+// other errors are fatal to the handshake
+func isRetryable(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && (ne.Timeout() || ne.Temporary())
+}
 
-	buf := make([]byte, sz)
+// readFull fills buf, reads failed by retryable errors are attempted again up
+// to config.HandshakeRetries times without losing bytes read so far
+func (c *Conn) readFull(buf []byte) error {
 	sum := 0
-	for sum < int(sz) {
+	for sum < len(buf) {
+		if c.config.HandshakeTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout))
+		}
 		n, err := c.conn.Read(buf[sum:])
-		if err != nil {
+		sum += n
+		if err != nil && sum < len(buf) {
+			if isRetryable(err) && c.handshakeRetries < c.config.HandshakeRetries {
+				c.handshakeRetries++
+				continue
+			}
+			if err == io.EOF && sum > 0 {
+				err = io.ErrUnexpectedEOF
+			}
 			return err
 		}
-		sum += n
+	}
+	return nil
+}
+
+func (c *Conn) readRecord(msg handshakeMessage) error {
+	var head [2]byte
+	if err := c.readFull(head[:]); err != nil {
+		return err
+	}
+	sz := binary.BigEndian.Uint16(head[:])
+
+	buf := make([]byte, sz)
+	if err := c.readFull(buf); err != nil {
+		return err
 	}
 
 	if err := msg.unmarshal(buf); err != nil {
@@ -256,9 +291,13 @@ func (c *Conn) clientNewHandshake() error {
 	pubKey := dh64.PublicKey(priKey)
 
 	nq := &newConnReq{
-		id:           0,
-		key:          toLeu64(pubKey),
-		targetServer: c.config.TargetServer,
+		id:            0,
+		key:           toLeu64(pubKey),
+		targetServer:  c.config.TargetServer,
+		sentCacheSize: c.config.RequestSentCacheSize,
+	}
+	if c.config.Token != "" {
+		nq.setTokenSum(c.config.Token)
 	}
 
 	if err := c.writeRecord(nq); err != nil {
@@ -275,7 +314,8 @@ func (c *Conn) clientNewHandshake() error {
 	}
 
 	secret := dh64.Secret(priKey, np.key.Uint64())
-	c.initNewConn(np.id, toLeu64(secret))
+	c.initNewConn(np.id, toLeu64(secret), c.config.SentCacheSize)
+	c.peerSentCacheSize = np.sentCacheSize
 	return nil
 }
 
@@ -312,6 +352,11 @@ OuterLoop:
 			break OuterLoop
 		}
 
+		if c.config.AllowReuse != nil && !c.config.AllowReuse(oldConn, c.conn.RemoteAddr()) {
+			rp.code = SCPStatusUnauthorized
+			break OuterLoop
+		}
+
 		// all check pass, close old
 		oldConn = c.config.ScpServer.CloseByID(rq.id)
 
@@ -353,6 +398,11 @@ OuterLoop:
 }
 
 func (c *Conn) serverNewHandshake(nq *newConnReq) error {
+	// no response, the client only learns that the conn is closed
+	if c.config.Token != "" && !nq.verifyToken(c.config.Token) {
+		return ErrTokenMismatch
+	}
+
 	priKey := dh64.PrivateKey()
 	pubKey := dh64.PublicKey(priKey)
 
@@ -361,6 +411,11 @@ func (c *Conn) serverNewHandshake(nq *newConnReq) error {
 		id:  id,
 		key: toLeu64(pubKey),
 	}
+	sentCacheSize := c.config.SentCacheSize
+	if nq.sentCacheSize > 0 && c.config.SentCacheMax > 0 {
+		sentCacheSize = clampSentCacheSize(nq.sentCacheSize, c.config.SentCacheMin, c.config.SentCacheMax)
+		np.sentCacheSize = sentCacheSize
+	}
 
 	if err := c.writeRecord(np); err != nil {
 		c.config.ScpServer.ReleaseID(id)
@@ -368,13 +423,24 @@ func (c *Conn) serverNewHandshake(nq *newConnReq) error {
 	}
 
 	secret := dh64.Secret(priKey, nq.key.Uint64())
-	c.initNewConn(id, toLeu64(secret))
+	c.initNewConn(id, toLeu64(secret), sentCacheSize)
 
 	// set preferred target
 	c.config.TargetServer = nq.targetServer
 	return nil
 }
 
+// clampSentCacheSize limits a requested sent cache size into [min, max]
+func clampSentCacheSize(size, min, max int) int {
+	if size < min {
+		return min
+	}
+	if size > max {
+		return max
+	}
+	return size
+}
+
 func (c *Conn) serverHandshake() error {
 	var sq serverReq
 	if err := c.readRecord(&sq); err != nil {
@@ -410,6 +476,9 @@ func (c *Conn) Handshake() error {
 	} else {
 		c.handshakeErr = c.serverHandshake()
 	}
+	if c.config.HandshakeTimeout > 0 {
+		c.conn.SetReadDeadline(time.Time{})
+	}
 
 	if c.handshakeErr != nil {
 		return c.handshakeErr
@@ -479,6 +548,25 @@ func (c *Conn) RawConn() net.Conn {
 	return c.conn
 }
 
+// SentCacheSize returns capacity of the sent cache
+func (c *Conn) SentCacheSize() int {
+	if c.sentCache == nil {
+		return 0
+	}
+	return c.sentCache.Cap()
+}
+
+// PeerSentCacheSize returns the sent cache size granted by server to a
+// client request, 0 if not requested or ignored by server
+func (c *Conn) PeerSentCacheSize() int {
+	return c.peerSentCacheSize
+}
+
+// HandshakeRetries returns the number of handshake reads retried after temporary errors
+func (c *Conn) HandshakeRetries() int {
+	return c.handshakeRetries
+}
+
 func (c *Conn) ID() int {
 	return c.id
 }
@@ -0,0 +1,371 @@
+package scp
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ejoy/goscon/dh64"
+)
+
+// testServer keeps handshaked server conns by id
+type testServer struct {
+	sync.Mutex
+	lastID int
+	conns  map[int]*Conn
+}
+
+func (s *testServer) AcquireID() int {
+	s.Lock()
+	defer s.Unlock()
+	s.lastID++
+	return s.lastID
+}
+
+func (s *testServer) ReleaseID(id int) {}
+
+func (s *testServer) QueryByID(id int) *Conn {
+	s.Lock()
+	defer s.Unlock()
+	return s.conns[id]
+}
+
+func (s *testServer) CloseByID(id int) *Conn {
+	s.Lock()
+	defer s.Unlock()
+	conn := s.conns[id]
+	delete(s.conns, id)
+	return conn
+}
+
+// lossyConn drops written bytes once lost is set, as if the link broke
+type lossyConn struct {
+	net.Conn
+	lost int32
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.lost) != 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// handshake runs handshake of client and a server conn of config over a
+// pipe, the server conn is registered by id
+func handshake(t *testing.T, s *testServer, client func(net.Conn) *Conn, config *Config) (*Conn, *Conn, *lossyConn) {
+	clientRaw, serverRaw := net.Pipe()
+	lossy := &lossyConn{Conn: serverRaw}
+	clientRaw.SetDeadline(time.Now().Add(3 * time.Second))
+	serverRaw.SetDeadline(time.Now().Add(3 * time.Second))
+
+	server := Server(lossy, config)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+
+	c := client(clientRaw)
+	if err := c.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+
+	s.Lock()
+	s.conns[server.ID()] = server
+	s.Unlock()
+	return c, server, lossy
+}
+
+func TestNegotiatedSentCache(t *testing.T) {
+	s := &testServer{conns: make(map[int]*Conn)}
+	config := &Config{
+		ScpServer:     s,
+		SentCacheSize: 4096,
+		SentCacheMin:  1024,
+		SentCacheMax:  1 << 20,
+	}
+
+	cases := []struct {
+		request, granted int
+		lost             int // bytes lost before reconnecting
+		ok               bool
+	}{
+		{0, 0, 1000, true},
+		{0, 0, 8000, false}, // over server default
+		{256 << 10, 256 << 10, 200 << 10, true},
+		{256 << 10, 256 << 10, 300 << 10, false},
+		{16, 1024, 1000, true},
+		{4 << 20, 1 << 20, 1 << 20, true},
+	}
+	for i, c := range cases {
+		clientConfig := &Config{RequestSentCacheSize: c.request}
+		client, server, lossy := handshake(t, s, func(conn net.Conn) *Conn {
+			return Client(conn, clientConfig)
+		}, config)
+		if client.PeerSentCacheSize() != c.granted {
+			t.Errorf("case %d: granted %d, expected %d", i, client.PeerSentCacheSize(), c.granted)
+		}
+		size := c.granted
+		if size == 0 {
+			size = config.SentCacheSize
+		}
+		if server.SentCacheSize() != size {
+			t.Errorf("case %d: sent cache %d, expected %d", i, server.SentCacheSize(), size)
+		}
+
+		atomic.StoreInt32(&lossy.lost, 1)
+		data := make([]byte, c.lost)
+		crand.Read(data)
+		if _, err := server.Write(data); err != nil {
+			t.Fatalf("case %d: write: %v", i, err)
+		}
+
+		clientRaw, serverRaw := net.Pipe()
+		clientRaw.SetDeadline(time.Now().Add(3 * time.Second))
+		serverRaw.SetDeadline(time.Now().Add(3 * time.Second))
+		reused := Server(serverRaw, config)
+		errc := make(chan error, 1)
+		go func() { errc <- reused.Handshake() }()
+
+		reuse := Client(clientRaw, &Config{ConnForReused: client})
+		err := reuse.Handshake()
+		if !c.ok {
+			if err != ErrNotAcceptable {
+				t.Errorf("case %d: reuse after losing %d bytes: %v", i, c.lost, err)
+			}
+			<-errc
+			clientRaw.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: reuse: %v", i, err)
+		}
+		if reuse.PeerSentCacheSize() != c.granted {
+			t.Errorf("case %d: reused granted %d, expected %d", i, reuse.PeerSentCacheSize(), c.granted)
+		}
+
+		replayed := make([]byte, len(data))
+		if _, err := io.ReadFull(reuse, replayed); err != nil {
+			t.Fatalf("case %d: read replayed: %v", i, err)
+		}
+		if !bytes.Equal(replayed, data) {
+			t.Errorf("case %d: replayed data differs", i)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("case %d: server reuse: %v", i, err)
+		}
+		if reused.SentCacheSize() != size {
+			t.Errorf("case %d: reused sent cache %d, expected %d", i, reused.SentCacheSize(), size)
+		}
+		clientRaw.Close()
+	}
+}
+
+func TestNewConnReqSentCache(t *testing.T) {
+	cases := []struct {
+		msg  string
+		size int
+		ok   bool
+	}{
+		{"0\nAAAAAAAAAAA=", 0, true},
+		{"0\nAAAAAAAAAAA=\ngame", 0, true},
+		{"0\nAAAAAAAAAAA=\n\n65536", 65536, true},
+		{"0\nAAAAAAAAAAA=\ngame\n-1", 0, false},
+		{"0\nAAAAAAAAAAA=\ngame\nlots", 0, false},
+		{"0\nAAAAAAAAAAA=\ngame\n2147483648", 0, false},
+	}
+	for i, c := range cases {
+		var nq newConnReq
+		err := nq.unmarshal([]byte(c.msg))
+		if (err == nil) != c.ok {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if c.ok && nq.sentCacheSize != c.size {
+			t.Errorf("case %d: size %d, expected %d", i, nq.sentCacheSize, c.size)
+		}
+	}
+
+	nq := newConnReq{sentCacheSize: 65536}
+	var parsed newConnReq
+	if err := parsed.unmarshal(nq.marshal()); err != nil || parsed.sentCacheSize != 65536 || parsed.targetServer != "" {
+		t.Errorf("round trip: %+v, %v", parsed, err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	cases := []struct {
+		server, client string
+		ok             bool
+	}{
+		{"", "", true},
+		{"", "secret", true}, // not checked
+		{"secret", "secret", true},
+		{"secret", "", false},
+		{"secret", "guess", false},
+	}
+	for i, c := range cases {
+		s := &testServer{conns: make(map[int]*Conn)}
+		clientRaw, serverRaw := net.Pipe()
+		clientRaw.SetDeadline(time.Now().Add(3 * time.Second))
+		serverRaw.SetDeadline(time.Now().Add(3 * time.Second))
+
+		server := Server(serverRaw, &Config{ScpServer: s, Token: c.server})
+		errc := make(chan error, 1)
+		go func() {
+			err := server.Handshake()
+			if err != nil {
+				serverRaw.Close()
+			}
+			errc <- err
+		}()
+		client := Client(clientRaw, &Config{Token: c.client})
+		clientErr := client.Handshake()
+		serverErr := <-errc
+		if c.ok {
+			if clientErr != nil || serverErr != nil {
+				t.Errorf("case %d: client %v, server %v", i, clientErr, serverErr)
+			}
+		} else {
+			if clientErr == nil || serverErr != ErrTokenMismatch {
+				t.Errorf("case %d: client %v, server %v", i, clientErr, serverErr)
+			}
+			if s.lastID != 0 {
+				t.Errorf("case %d: id acquired for rejected conn", i)
+			}
+		}
+		clientRaw.Close()
+	}
+}
+
+// timeoutError is a net.Error as of an expired read deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// scriptedRead is data returned by a read, then err
+type scriptedRead struct {
+	data []byte
+	err  error
+}
+
+// scriptedConn replays reads of a script and discards writes, reads past
+// the script fail with io.EOF
+type scriptedConn struct {
+	net.Conn
+	reads []scriptedRead
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return 0, io.EOF
+	}
+	r := &c.reads[0]
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	if len(r.data) > 0 {
+		return n, nil
+	}
+	err := r.err
+	c.reads = c.reads[1:]
+	return n, err
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// expected errors of TestHandshakeRetries matched by kind
+var (
+	errTimeout   = errors.New("timeout")
+	errBadRecord = errors.New("bad record")
+)
+
+func TestHandshakeRetries(t *testing.T) {
+	nq := &newConnReq{key: toLeu64(dh64.PublicKey(dh64.PrivateKey()))}
+	msg := nq.marshal()
+	record := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(record, uint16(len(msg)))
+	copy(record[2:], msg)
+	// a record whose body is not a handshake message
+	bad := []byte{0, 4, 'b', 'a', 'd', '!'}
+
+	timeout := scriptedRead{err: timeoutError{}}
+	// the record is cut at head and in the middle of its line
+	split := func(reads ...scriptedRead) []scriptedRead {
+		script := []scriptedRead{{data: record[:1]}}
+		script = append(script, reads...)
+		script = append(script, scriptedRead{data: record[1:8]})
+		script = append(script, reads...)
+		return append(script, scriptedRead{data: record[8:]})
+	}
+
+	cases := []struct {
+		retries int // config.HandshakeRetries
+		reads   []scriptedRead
+		err     error // nil if ok, errTimeout for a timeout error
+		retried int
+	}{
+		{2, split(), nil, 0},
+		{2, split(timeout), nil, 2},
+		{4, split(timeout, timeout), nil, 4},
+		{3, split(timeout, timeout), errTimeout, 3},
+		{0, split(timeout), errTimeout, 0},
+		{2, []scriptedRead{{data: record[:8], err: timeout.err}, {data: record[8:]}}, nil, 1}, // bytes read with the error are kept
+		{2, []scriptedRead{{data: record[:8], err: io.EOF}}, io.ErrUnexpectedEOF, 0},
+		{2, []scriptedRead{{err: io.EOF}, timeout}, io.EOF, 0},
+		{2, []scriptedRead{{data: bad}, timeout}, errBadRecord, 0},
+	}
+	for i, c := range cases {
+		s := &testServer{conns: make(map[int]*Conn)}
+		conn := Server(&scriptedConn{reads: c.reads}, &Config{ScpServer: s, HandshakeRetries: c.retries})
+		err := conn.Handshake()
+		switch c.err {
+		case nil:
+			if err != nil {
+				t.Errorf("case %d: %v", i, err)
+			}
+		case errTimeout:
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Errorf("case %d: %v, expected timeout", i, err)
+			}
+		case errBadRecord:
+			if err == nil || isRetryable(err) {
+				t.Errorf("case %d: %v, expected fatal error", i, err)
+			}
+		default:
+			if err != c.err {
+				t.Errorf("case %d: %v, expected %v", i, err, c.err)
+			}
+		}
+		if conn.HandshakeRetries() != c.retried {
+			t.Errorf("case %d: retried %d, expected %d", i, conn.HandshakeRetries(), c.retried)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{timeoutError{}, true},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, true},
+		{io.EOF, false},
+		{io.ErrUnexpectedEOF, false},
+		{ErrTokenMismatch, false},
+	}
+	for i, c := range cases {
+		if isRetryable(c.err) != c.retryable {
+			t.Errorf("case %d: %v retryable %v", i, c.err, !c.retryable)
+		}
+	}
+}
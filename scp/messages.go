@@ -1,7 +1,7 @@
 package scp
 
 import (
-	"bytes"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"strconv"
@@ -33,20 +33,54 @@ type handshakeMessage interface {
 	unmarshal([]byte) error
 }
 
+// MaxSentCacheRequest is the largest sent cache size a client may request,
+// larger requests are illegal rather than clamped
+const MaxSentCacheRequest = 1 << 30
+
 type newConnReq struct {
-	id           int
-	key          leu64
-	targetServer string
+	id            int
+	key           leu64
+	targetServer  string
+	sentCacheSize int // requested sent cache size of server, 0 means server default
+	signed        bool
+	tokenSum      leu64 // proves the client knows the token, valid if signed
+}
+
+// setTokenSum signs the request by token, bound to the key so that a sum
+// can't be used with another key
+func (r *newConnReq) setTokenSum(token string) {
+	r.tokenSum = hmac(hash([]byte(token)), r.key)
+	r.signed = true
+}
+
+func (r *newConnReq) verifyToken(token string) bool {
+	sum := hmac(hash([]byte(token)), r.key)
+	return r.signed && subtle.ConstantTimeCompare(r.tokenSum[:], sum[:]) == 1
 }
 
 func (r *newConnReq) marshal() []byte {
 	s := fmt.Sprintf("%d\n%s", r.id, b64encodeLeu64(r.key))
-	if r.targetServer != "" {
+	if r.targetServer != "" || r.sentCacheSize > 0 || r.signed {
 		s += fmt.Sprintf("\n%s", r.targetServer)
 	}
+	if r.sentCacheSize > 0 || r.signed {
+		s += fmt.Sprintf("\n%d", r.sentCacheSize)
+	}
+	if r.signed {
+		s += fmt.Sprintf("\n%s", b64encodeLeu64(r.tokenSum))
+	}
 	return []byte(s)
 }
 
+// parseSentCacheSize parses a sent cache size line, absurd sizes are illegal
+func parseSentCacheSize(line string) (int, error) {
+	size, err := strconv.Atoi(line)
+	if err != nil || size < 0 || size > MaxSentCacheRequest {
+		return 0, ErrIllegalMsg
+	}
+	return size, nil
+}
+
 func (r *newConnReq) unmarshal(s []byte) (err error) {
 	lines := strings.Split(string(s), "\n")
 	if len(lines) < 2 {
@@ -65,16 +99,33 @@ func (r *newConnReq) unmarshal(s []byte) (err error) {
 	if len(lines) >= 3 {
 		r.targetServer = lines[2]
 	}
+
+	if len(lines) >= 4 {
+		if r.sentCacheSize, err = parseSentCacheSize(lines[3]); err != nil {
+			return
+		}
+	}
+
+	if len(lines) >= 5 {
+		if r.tokenSum, err = b64decodeLeu64(lines[4]); err != nil {
+			return
+		}
+		r.signed = true
+	}
 	return
 }
 
 type newConnResp struct {
-	id  int
-	key leu64
+	id            int
+	key           leu64
+	sentCacheSize int // granted sent cache size, only sent if requested
 }
 
 func (r *newConnResp) marshal() []byte {
 	s := fmt.Sprintf("%d\n%s", r.id, b64encodeLeu64(r.key))
+	if r.sentCacheSize > 0 {
+		s += fmt.Sprintf("\n%d", r.sentCacheSize)
+	}
 	return []byte(s)
 }
 
@@ -92,6 +143,10 @@ func (r *newConnResp) unmarshal(s []byte) (err error) {
 	if r.key, err = b64decodeLeu64(lines[1]); err != nil {
 		return
 	}
+
+	if len(lines) >= 3 {
+		r.sentCacheSize, err = parseSentCacheSize(lines[2])
+	}
 	return
 }
 
@@ -105,7 +160,7 @@ type reuseConnReq struct {
 func (r *reuseConnReq) verifySum(secret leu64) bool {
 	s := fmt.Sprintf("%d\n%d\n%d\n", r.id, r.handshakes, r.received)
 	sum := hmac(hash([]byte(s)), secret)
-	return bytes.Equal(r.sum[:], sum[:])
+	return subtle.ConstantTimeCompare(r.sum[:], sum[:]) == 1
 }
 func (r *reuseConnReq) setSum(secret leu64) {
 	s := fmt.Sprintf("%d\n%d\n%d\n", r.id, r.handshakes, r.received)
@@ -3,6 +3,7 @@ package scp
 
 import (
 	"net"
+	"time"
 )
 
 type SCPServer interface {
@@ -31,13 +32,50 @@ type Config struct {
 	// SCPServer
 	// for server
 	ScpServer SCPServer
+
+	// sent cache size of new conn, SentCacheSize if zero
+	SentCacheSize int
+
+	// sent cache size of the server side requested at handshake, 0 means
+	// server default
+	// for client
+	RequestSentCacheSize int
+
+	// range of sent cache sizes granted to client requests, requests are
+	// clamped into it, SentCacheMax 0 means requests are ignored
+	// for server
+	SentCacheMin int
+	SentCacheMax int
+
+	// shared secret of new conns, clients sign the handshake with it and
+	// servers require it if not empty, reused conns are not checked
+	Token string
+
+	// check whether oldConn may be reused from remote, before oldConn is closed,
+	// nil allows all
+	// for server
+	AllowReuse func(oldConn *Conn, remote net.Addr) bool
+
+	// timeout of each read in handshake, 0 means no timeout
+	HandshakeTimeout time.Duration
+
+	// retries of handshake reads failed by temporary errors, such as HandshakeTimeout
+	HandshakeRetries int
 }
 
 var defaultConfig = &Config{}
 
 func (config *Config) clone() *Config {
 	return &Config{
-		ScpServer: config.ScpServer,
+		ScpServer:     config.ScpServer,
+		SentCacheSize: config.SentCacheSize,
+		SentCacheMin:  config.SentCacheMin,
+		SentCacheMax:  config.SentCacheMax,
+		Token:         config.Token,
+		AllowReuse:    config.AllowReuse,
+
+		HandshakeTimeout: config.HandshakeTimeout,
+		HandshakeRetries: config.HandshakeRetries,
 	}
 }
 
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// accessList admits clients by source ip, deny wins over allow and an empty
+// allow list admits everyone not denied
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseCIDR parses a cidr, a plain ip is a network of itself
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid cidr %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %s", s)
+	}
+	return n, nil
+}
+
+// newAccessList parses allow and deny, returns nil if both are empty, and
+// the problems found
+func newAccessList(allow, deny []string) (*accessList, []string) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	var problems []string
+	l := &accessList{}
+	for _, s := range allow {
+		n, err := parseCIDR(s)
+		if err != nil {
+			problems = append(problems, "allow: "+err.Error())
+			continue
+		}
+		l.allow = append(l.allow, n)
+	}
+	for _, s := range deny {
+		n, err := parseCIDR(s)
+		if err != nil {
+			problems = append(problems, "deny: "+err.Error())
+			continue
+		}
+		l.deny = append(l.deny, n)
+	}
+	return l, problems
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether ip may connect, a nil list allows everyone and an
+// unknown ip is allowed only if there is no allow list
+func (l *accessList) allowed(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	if ip == nil {
+		return len(l.allow) == 0
+	}
+	if containsIP(l.deny, ip) {
+		return false
+	}
+	return len(l.allow) == 0 || containsIP(l.allow, ip)
+}
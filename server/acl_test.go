@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	cases := []struct {
+		allow, deny []string
+		ip          string
+		ok          bool
+	}{
+		{nil, nil, "10.0.0.1", true},
+		{[]string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, nil, "192.168.0.1", false},
+		{[]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.1.2.3", false},
+		{[]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.2.0.1", true},
+		{nil, []string{"192.168.0.1"}, "192.168.0.1", false},
+		{nil, []string{"192.168.0.1"}, "192.168.0.2", true},
+		{[]string{"10.0.0.0/8"}, nil, "::ffff:10.0.0.1", true},
+		{[]string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{[]string{"2001:db8::/32"}, nil, "10.0.0.1", false},
+		{nil, []string{"10.0.0.0/8"}, "", true},
+		{[]string{"10.0.0.0/8"}, nil, "", false},
+	}
+	for i, c := range cases {
+		l, problems := newAccessList(c.allow, c.deny)
+		if len(problems) > 0 {
+			t.Fatalf("case %d: %v", i, problems)
+		}
+		if ok := l.allowed(net.ParseIP(c.ip)); ok != c.ok {
+			t.Errorf("case %d: %s allowed %v, expected %v", i, c.ip, ok, c.ok)
+		}
+	}
+
+	if _, problems := newAccessList([]string{"10.0.0.0/33", "x"}, []string{"10.0.0.0/8"}); len(problems) != 2 {
+		t.Errorf("problems %q, expected 2", problems)
+	}
+}
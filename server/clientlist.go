@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// clientEntry throttles or denies a single client ip
+type clientEntry struct {
+	IP     string    `json:"ip"`
+	Rate   int       `json:"rate"`   // new connections per second, 0 means deny
+	Expire time.Time `json:"expire"` // zero means never expire
+
+	last time.Time // last allowed connection
+}
+
+func (e *clientEntry) expired(now time.Time) bool {
+	return !e.Expire.IsZero() && now.After(e.Expire)
+}
+
+// clientList is a dynamic throttle/deny list managed at runtime
+type clientList struct {
+	sync.Mutex
+	entries *ipTable // of *clientEntry
+}
+
+func (cl *clientList) Add(ip string, rate int, ttl time.Duration) error {
+	e := &clientEntry{
+		IP:   ip,
+		Rate: rate,
+	}
+	if ttl > 0 {
+		e.Expire = time.Now().Add(ttl)
+	}
+
+	cl.Lock()
+	defer cl.Unlock()
+	return cl.entries.Put(ip, e)
+}
+
+func (cl *clientList) Remove(ip string) bool {
+	cl.Lock()
+	defer cl.Unlock()
+	return cl.entries.Delete(ip)
+}
+
+// List returns live entries sorted by ip, expired entries are purged
+func (cl *clientList) List() []clientEntry {
+	cl.Lock()
+	defer cl.Unlock()
+	now := time.Now()
+	entries := make([]clientEntry, 0, cl.entries.Len())
+	cl.entries.Range(func(ip string, v interface{}) {
+		e := v.(*clientEntry)
+		if e.expired(now) {
+			cl.entries.Delete(ip)
+			return
+		}
+		entries = append(entries, *e)
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].IP < entries[j].IP
+	})
+	return entries
+}
+
+// Allow reports whether a new connection from ip is accepted
+func (cl *clientList) Allow(ip string) bool {
+	cl.Lock()
+	defer cl.Unlock()
+	v, ok := cl.entries.Get(ip)
+	if !ok {
+		return true
+	}
+	e := v.(*clientEntry)
+
+	now := time.Now()
+	if e.expired(now) {
+		cl.entries.Delete(ip)
+		return true
+	}
+
+	if e.Rate <= 0 {
+		return false
+	}
+
+	if now.Sub(e.last) < time.Second/time.Duration(e.Rate) {
+		return false
+	}
+	e.last = now
+	return true
+}
+
+func newClientList(max int, policy string) *clientList {
+	return &clientList{
+		entries: newIPTable(max, policy),
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	eventBufferSize   = 256 // events buffered per subscriber
+	eventWriteTimeout = 10 * time.Second
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// handleClients manages the dynamic client throttle/deny list
+//
+//	GET                             list entries
+//	POST   ?ip=IP[&rate=N][&ttl=S]  add entry, rate 0 means deny, ttl 0 means never expire
+//	DELETE ?ip=IP                   remove entry
+func (ss *SCPServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	clients := ss.clients
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, clients.List())
+	case http.MethodPost:
+		ip := net.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		var rate, ttl int
+		var err error
+		if v := r.FormValue("rate"); v != "" {
+			if rate, err = strconv.Atoi(v); err != nil || rate < 0 {
+				http.Error(w, "invalid rate", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.FormValue("ttl"); v != "" {
+			if ttl, err = strconv.Atoi(v); err != nil || ttl < 0 {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := clients.Add(ip.String(), rate, time.Duration(ttl)*time.Second); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		Log("control: add client %s, rate:%d, ttl:%ds", ip, rate, ttl)
+		fmt.Fprintln(w, "ok")
+	case http.MethodDelete:
+		ip := net.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		if !clients.Remove(ip.String()) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		Log("control: remove client %s", ip)
+		fmt.Fprintln(w, "ok")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleConfig returns the effective config
+func (ss *SCPServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, ss.provider.Snapshot())
+}
+
+// handleEvents streams session lifecycle events as json over websocket
+func (ss *SCPServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	events := ss.events
+	ch := events.Subscribe(eventBufferSize)
+	defer events.Unsubscribe(ch)
+
+	done := make(chan struct{})
+	go func() {
+		discardWebsocketFrames(rw.Reader)
+		close(done)
+	}()
+
+	for {
+		select {
+		case e := <-ch:
+			data, _ := json.Marshal(e)
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := writeWebsocketFrame(rw.Writer, wsOpText, data); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// handleReload reloads the config file, like SIG_RELOAD
+func (ss *SCPServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := ss.Reload(); err != nil {
+		Log("control: reload failed: %s", err.Error())
+		http.Error(w, "reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Log("control: reload succeed")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleStatus returns the data of SIG_STATUS
+func (ss *SCPServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, ss.Status())
+}
+
+// handleHealthz reports whether the server accepts new connections
+func (ss *SCPServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if ss.IsDraining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleMetrics exports metrics in prometheus text format
+func (ss *SCPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	ss.metrics.write(w, ss)
+}
+
+// StartControl serves the control endpoints, it should be bound to a local address
+func (ss *SCPServer) StartControl(laddr string) error {
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", ss.handleClients)
+	mux.HandleFunc("/events", ss.handleEvents)
+	mux.HandleFunc("/config", ss.handleConfig)
+	mux.HandleFunc("/reload", ss.handleReload)
+	mux.HandleFunc("/status", ss.handleStatus)
+	mux.HandleFunc("/healthz", ss.handleHealthz)
+	if ss.metrics != nil {
+		mux.HandleFunc("/metrics", ss.handleMetrics)
+	}
+
+	Info("control listen on %s", ln.Addr())
+	go func() {
+		Error("control server exit: %v", http.Serve(ln, mux))
+	}()
+	return nil
+}
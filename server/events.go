@@ -0,0 +1,77 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EventOpen      = "open"
+	EventReconnect = "reconnect"
+	EventClose     = "close"
+)
+
+// SessionEvent describes a session lifecycle change
+type SessionEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	ID      int       `json:"id"`
+	Session string    `json:"session"` // id prefixed with instance
+	Remote  string    `json:"remote"`
+	Host    string    `json:"host,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// eventHub fans out session events to subscribers, events are dropped
+// for slow subscribers rather than blocking the publisher
+type eventHub struct {
+	sync.RWMutex
+	subscribers map[chan *SessionEvent]struct{}
+
+	active  int32 // number of subscribers, atomic
+	dropped int64 // atomic
+}
+
+func (h *eventHub) Subscribe(size int) chan *SessionEvent {
+	ch := make(chan *SessionEvent, size)
+	h.Lock()
+	defer h.Unlock()
+	h.subscribers[ch] = struct{}{}
+	atomic.StoreInt32(&h.active, int32(len(h.subscribers)))
+	return ch
+}
+
+func (h *eventHub) Unsubscribe(ch chan *SessionEvent) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.subscribers, ch)
+	atomic.StoreInt32(&h.active, int32(len(h.subscribers)))
+}
+
+// Active reports whether anyone is listening, so callers can skip building events
+func (h *eventHub) Active() bool {
+	return atomic.LoadInt32(&h.active) > 0
+}
+
+func (h *eventHub) Publish(e *SessionEvent) {
+	h.RLock()
+	defer h.RUnlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddInt64(&h.dropped, 1)
+		}
+	}
+}
+
+func (h *eventHub) NumOfDropped() int64 {
+	return atomic.LoadInt64(&h.dropped)
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[chan *SessionEvent]struct{}),
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"time"
+)
+
+const defaultHealthTimeout = 3 * time.Second
+
+// checkHealth periodically dials every host of the running config, hosts failed
+// to connect are marked down and skipped by selection until a check succeeds
+func (tp *LocalConnProvider) checkHealth() {
+	for {
+		tp.Lock()
+		interval := time.Duration(tp.config.HealthInterval) * time.Second
+		timeout := time.Duration(tp.config.HealthTimeout) * time.Second
+		tp.Unlock()
+
+		if interval <= 0 {
+			// check again later, a reload may enable it
+			if !tp.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+		if timeout <= 0 {
+			timeout = defaultHealthTimeout
+		}
+
+		if !tp.sleep(interval) {
+			return
+		}
+
+		tp.Lock()
+		hosts := tp.hosts
+		tp.Unlock()
+		tp.checkHosts(hosts, timeout)
+	}
+}
+
+// checkHosts dials hosts concurrently and waits for all of them
+func (tp *LocalConnProvider) checkHosts(hosts []Host, timeout time.Duration) {
+	done := make(chan struct{}, len(hosts))
+	for i := range hosts {
+		go func(host *Host) {
+			defer func() { done <- struct{}{} }()
+			conn, err := tp.dialHost(host, timeout, nil)
+			if err == nil {
+				conn.Close()
+			}
+			if !host.state.setDown(err != nil) {
+				return
+			}
+			if err != nil {
+				host.state.pool.drain()
+				Error("host %s(%s) is down: %s", host.Name, host.addr, err.Error())
+			} else {
+				Log("host %s(%s) is up", host.Name, host.addr)
+			}
+		}(&hosts[i])
+	}
+	for range hosts {
+		<-done
+	}
+}
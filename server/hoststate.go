@@ -0,0 +1,96 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// hostState is runtime state of a host, kept across reloads
+type hostState struct {
+	conns int64 // sessions on the host, atomic
+	down  int32 // 1 if the last health check failed, atomic
+
+	sync.Mutex
+
+	// rolling window of recent dial outcomes, true means failure
+	dialResults  []bool
+	dialNext     int
+	dialSamples  int
+	dialFailures int
+
+	pool warmPool // pre-dialed conns, dropped with the state when the host is removed
+}
+
+func (s *hostState) recordDial(failed bool) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.dialResults) == 0 {
+		return
+	}
+	if s.dialSamples == len(s.dialResults) {
+		if s.dialResults[s.dialNext] {
+			s.dialFailures--
+		}
+	} else {
+		s.dialSamples++
+	}
+	s.dialResults[s.dialNext] = failed
+	if failed {
+		s.dialFailures++
+	}
+	s.dialNext = (s.dialNext + 1) % len(s.dialResults)
+}
+
+// DialFailureRatio returns failure ratio of dials in window and the number of dials
+func (s *hostState) DialFailureRatio() (float64, int) {
+	s.Lock()
+	defer s.Unlock()
+	if s.dialSamples == 0 {
+		return 0, 0
+	}
+	return float64(s.dialFailures) / float64(s.dialSamples), s.dialSamples
+}
+
+// acquireConn counts a new session on the host, fails if max sessions reached, 0 means no limit
+func (s *hostState) acquireConn(max int) bool {
+	for {
+		n := atomic.LoadInt64(&s.conns)
+		if max > 0 && n >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.conns, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (s *hostState) releaseConn() {
+	atomic.AddInt64(&s.conns, -1)
+}
+
+func (s *hostState) full(max int) bool {
+	return max > 0 && atomic.LoadInt64(&s.conns) >= int64(max)
+}
+
+func (s *hostState) NumOfConns() int64 {
+	return atomic.LoadInt64(&s.conns)
+}
+
+// setDown records result of a health check, reports whether it changed
+func (s *hostState) setDown(down bool) bool {
+	var v int32
+	if down {
+		v = 1
+	}
+	return atomic.SwapInt32(&s.down, v) != v
+}
+
+func (s *hostState) isDown() bool {
+	return atomic.LoadInt32(&s.down) != 0
+}
+
+func newHostState(dialWindow int) *hostState {
+	return &hostState{
+		dialResults: make([]bool, dialWindow),
+	}
+}
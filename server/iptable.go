@@ -0,0 +1,107 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"sync/atomic"
+)
+
+var errIPTableFull = errors.New("ip table full")
+
+// ipTable policies when full
+const (
+	IPTableOpen   = "open"   // evict the least recently used entry, its state is lost
+	IPTableClosed = "closed" // refuse new entries, existing state is kept
+)
+
+// ipTable is a bounded map of per ip state, so tracking cannot be used to
+// exhaust memory by floods of spoofed sources. It is not safe for concurrent
+// use, callers guard it with their own lock.
+type ipTable struct {
+	evicted  int64 // atomic
+	refused  int64 // atomic
+	size     int32 // atomic, for readers without the lock
+	max      int   // 0 means unlimited
+	closed   bool  // refuse new entries instead of evicting
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+type ipTableEntry struct {
+	ip    string
+	value interface{}
+}
+
+// Get returns state of ip and marks it recently used
+func (t *ipTable) Get(ip string) (interface{}, bool) {
+	e, ok := t.elements[ip]
+	if !ok {
+		return nil, false
+	}
+	t.order.MoveToFront(e)
+	return e.Value.(*ipTableEntry).value, true
+}
+
+// Put sets state of ip, fails with errIPTableFull if full and policy is closed
+func (t *ipTable) Put(ip string, value interface{}) error {
+	if e, ok := t.elements[ip]; ok {
+		e.Value.(*ipTableEntry).value = value
+		t.order.MoveToFront(e)
+		return nil
+	}
+	if t.max > 0 && len(t.elements) >= t.max {
+		if t.closed {
+			atomic.AddInt64(&t.refused, 1)
+			return errIPTableFull
+		}
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.elements, oldest.Value.(*ipTableEntry).ip)
+		atomic.AddInt64(&t.evicted, 1)
+	}
+	t.elements[ip] = t.order.PushFront(&ipTableEntry{ip: ip, value: value})
+	atomic.StoreInt32(&t.size, int32(len(t.elements)))
+	return nil
+}
+
+func (t *ipTable) Delete(ip string) bool {
+	e, ok := t.elements[ip]
+	if !ok {
+		return false
+	}
+	t.order.Remove(e)
+	delete(t.elements, ip)
+	atomic.StoreInt32(&t.size, int32(len(t.elements)))
+	return true
+}
+
+// Range calls f for every entry, f may delete the entry it is called with
+func (t *ipTable) Range(f func(ip string, value interface{})) {
+	for e := t.order.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*ipTableEntry)
+		f(entry.ip, entry.value)
+		e = next
+	}
+}
+
+func (t *ipTable) Len() int {
+	return int(atomic.LoadInt32(&t.size))
+}
+
+func (t *ipTable) NumOfEvicted() int64 {
+	return atomic.LoadInt64(&t.evicted)
+}
+
+func (t *ipTable) NumOfRefused() int64 {
+	return atomic.LoadInt64(&t.refused)
+}
+
+func newIPTable(max int, policy string) *ipTable {
+	return &ipTable{
+		max:      max,
+		closed:   policy == IPTableClosed,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
@@ -0,0 +1,250 @@
+//
+//   date  : 2014-06-07
+//   author: xjdrew
+//
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogField is structured context of a log message
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// LogBackend writes log messages that passed level filtering, level is
+// debug, info, error, notice(always printed) or panic
+type LogBackend interface {
+	Output(level string, msg string, fields []LogField)
+}
+
+// textBackend prints messages only, context is already part of them
+type textBackend struct {
+	logger *log.Logger
+}
+
+func (b textBackend) Output(level string, msg string, fields []LogField) {
+	b.logger.Print(msg)
+}
+
+// jsonBackend prints one json object a line with level, time, message and fields
+type jsonBackend struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (b *jsonBackend) Output(level string, msg string, fields []LogField) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // session tags are <id>
+	writeField := func(key string, value interface{}) {
+		enc.Encode(key)
+		buf.Truncate(buf.Len() - 1) // newline of Encode
+		buf.WriteByte(':')
+		if err := enc.Encode(value); err != nil {
+			enc.Encode(fmt.Sprint(value))
+		}
+		buf.Truncate(buf.Len() - 1)
+		buf.WriteByte(',')
+	}
+	buf.WriteByte('{')
+	writeField("level", level)
+	writeField("time", time.Now().Format(time.RFC3339Nano))
+	writeField("msg", msg)
+	for _, f := range fields {
+		writeField(f.Key, f.Value)
+	}
+	buf.Truncate(buf.Len() - 1)
+	buf.WriteString("}\n")
+
+	b.Lock()
+	b.w.Write(buf.Bytes())
+	b.Unlock()
+}
+
+var backend LogBackend
+var logLevel int
+
+// SetLogLevel sets verbosity of Error, Info and Debug, larger for more detail
+func SetLogLevel(level int) {
+	logLevel = level
+}
+
+// SetLogBackend replaces the writer of all log messages
+func SetLogBackend(b LogBackend) {
+	backend = b
+}
+
+// SetLogFormat selects the text(default) or json backend on stderr
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatText:
+		SetLogBackend(newTextBackend(os.Stderr))
+	case LogFormatJSON:
+		SetLogBackend(&jsonBackend{w: os.Stderr})
+	default:
+		return fmt.Errorf("invalid log format: %s", format)
+	}
+	return nil
+}
+
+// backendFields reports whether the backend prints fields, context logged as
+// fields needn't be repeated in messages then
+func backendFields() bool {
+	_, ok := backend.(*jsonBackend)
+	return ok
+}
+
+func newTextBackend(w io.Writer) textBackend {
+	//return textBackend{log.New(w, "", log.Ldate|log.Lmicroseconds|log.Lshortfile)}
+	return textBackend{log.New(w, "", log.Ldate|log.Lmicroseconds)}
+}
+
+func init() {
+	backend = newTextBackend(os.Stderr)
+}
+
+func output(level string, fields []LogField, format string, a ...interface{}) {
+	backend.Output(level, fmt.Sprintf(format, a...), fields)
+}
+
+func Debug(format string, a ...interface{}) {
+	if logLevel > 2 {
+		output("debug", nil, format, a...)
+	}
+}
+
+func Info(format string, a ...interface{}) {
+	if logLevel > 1 {
+		output("info", nil, format, a...)
+	}
+}
+
+func Error(format string, a ...interface{}) {
+	if logLevel > 0 {
+		output("error", nil, format, a...)
+	}
+}
+
+func Panic(format string, a ...interface{}) {
+	output("panic", nil, format, a...)
+	panic("!!")
+}
+
+func Log(format string, a ...interface{}) {
+	output("notice", nil, format, a...)
+}
+
+func LogCurStack(format string, a ...interface{}) {
+	output("panic", nil, format, a...)
+	buf := make([]byte, 8192)
+	runtime.Stack(buf, false)
+	output("panic", nil, "!!!!!stack!!!!!: %s", buf)
+}
+
+func Recover() {
+	if err := recover(); err != nil {
+		LogCurStack("goroutine failed:%v", err)
+	}
+}
+
+// connLogger logs with context of a session, such as session id, client
+// addr and backend host. It is immutable, with returns a copy; methods of a
+// nil connLogger log without context.
+type connLogger struct {
+	fields []LogField
+}
+
+func newConnLogger(fields ...LogField) *connLogger {
+	return &connLogger{fields: fields}
+}
+
+// with returns a logger with fields added, values of existing keys replaced
+func (l *connLogger) with(fields ...LogField) *connLogger {
+	var merged []LogField
+	if l != nil {
+		merged = make([]LogField, len(l.fields), len(l.fields)+len(fields))
+		copy(merged, l.fields)
+	}
+next:
+	for _, f := range fields {
+		for i := range merged {
+			if merged[i].Key == f.Key {
+				merged[i] = f
+				continue next
+			}
+		}
+		merged = append(merged, f)
+	}
+	return &connLogger{fields: merged}
+}
+
+func (l *connLogger) context() []LogField {
+	if l == nil {
+		return nil
+	}
+	return l.fields
+}
+
+func (l *connLogger) Debug(format string, a ...interface{}) {
+	if logLevel > 2 {
+		output("debug", l.context(), format, a...)
+	}
+}
+
+func (l *connLogger) Info(format string, a ...interface{}) {
+	if logLevel > 1 {
+		output("info", l.context(), format, a...)
+	}
+}
+
+func (l *connLogger) Error(format string, a ...interface{}) {
+	if logLevel > 0 {
+		output("error", l.context(), format, a...)
+	}
+}
+
+func (l *connLogger) Log(format string, a ...interface{}) {
+	output("notice", l.context(), format, a...)
+}
+
+// logThrottle limits how often a repeated warning is printed
+type logThrottle struct {
+	sync.Mutex
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+// Allow reports whether a message can be printed now, and how many messages
+// were suppressed since the last allowed one.
+func (t *logThrottle) Allow() (bool, int) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	if now.Sub(t.last) < t.interval {
+		t.suppressed++
+		return false, 0
+	}
+	suppressed := t.suppressed
+	t.last = now
+	t.suppressed = 0
+	return true, suppressed
+}
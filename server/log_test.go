@@ -0,0 +1,40 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer SetLogBackend(backend)
+	defer SetLogLevel(logLevel)
+	SetLogBackend(&jsonBackend{w: &buf})
+	SetLogLevel(2)
+
+	log := newConnLogger(LogField{"session", "vm:1"}, LogField{"remote", "10.0.0.1:5000"})
+	log.with(LogField{"remote", "10.0.0.2:5000"}, LogField{"host", "test1"}).Info("<%s> new pair", "vm:1")
+	log.Debug("filtered by level")
+	Log("no context")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("%d lines: %s", len(lines), buf.String())
+	}
+	var record map[string]string
+	if err := json.Unmarshal(lines[0], &record); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"level": "info", "msg": "<vm:1> new pair", "session": "vm:1", "remote": "10.0.0.2:5000", "host": "test1"} {
+		if record[k] != v {
+			t.Errorf("%s: %q, expected %q", k, record[k], v)
+		}
+	}
+	if record["time"] == "" {
+		t.Error("no time")
+	}
+	if err := json.Unmarshal(lines[1], &record); err != nil || record["level"] != "notice" {
+		t.Errorf("record %s, %v", lines[1], err)
+	}
+}
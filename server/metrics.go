@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics collects counters exported in prometheus text format,
+// a nil *metrics discards everything so disabled metrics cost a nil check
+type metrics struct {
+	accepted int64 // accepted connections, atomic
+	reuses   int64 // sessions resumed by reconnection, atomic
+
+	mutex sync.Mutex
+	hosts map[string]*hostMetrics // by host name
+}
+
+// hostMetrics is the traffic of backend hosts sharing a name
+type hostMetrics struct {
+	dials        int64 // atomic
+	dialFailures int64 // atomic
+	download     int64 // bytes of client -> backend, atomic
+	upload       int64 // bytes of backend -> client, atomic
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		hosts: make(map[string]*hostMetrics),
+	}
+}
+
+func (m *metrics) addAccepted() {
+	if m != nil {
+		atomic.AddInt64(&m.accepted, 1)
+	}
+}
+
+func (m *metrics) addReuse() {
+	if m != nil {
+		atomic.AddInt64(&m.reuses, 1)
+	}
+}
+
+// host returns metrics of hosts named name, nil if m is nil
+func (m *metrics) host(name string) *hostMetrics {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	hm := m.hosts[name]
+	if hm == nil {
+		hm = &hostMetrics{}
+		m.hosts[name] = hm
+	}
+	return hm
+}
+
+func (m *metrics) recordDial(name string, failed bool) {
+	hm := m.host(name)
+	if hm == nil {
+		return
+	}
+	atomic.AddInt64(&hm.dials, 1)
+	if failed {
+		atomic.AddInt64(&hm.dialFailures, 1)
+	}
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabel quotes v as a prometheus label value
+func promLabel(v string) string {
+	return `"` + promLabelEscaper.Replace(v) + `"`
+}
+
+// write writes metrics of ss and m in prometheus text format
+func (m *metrics) write(w io.Writer, ss *SCPServer) {
+	pairs := ss.Pairs()
+	fmt.Fprintf(w, "# HELP goscon_conn_pairs Live sessions.\n# TYPE goscon_conn_pairs gauge\ngoscon_conn_pairs %d\n", pairs.Total)
+	fmt.Fprintf(w, "# HELP goscon_accepted_total Accepted connections.\n# TYPE goscon_accepted_total counter\ngoscon_accepted_total %d\n", atomic.LoadInt64(&m.accepted))
+	fmt.Fprintf(w, "# HELP goscon_reuses_total Sessions resumed by reconnection.\n# TYPE goscon_reuses_total counter\ngoscon_reuses_total %d\n", atomic.LoadInt64(&m.reuses))
+
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.hosts))
+	for name := range m.hosts {
+		names = append(names, name)
+	}
+	hosts := make([]*hostMetrics, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		hosts[i] = m.hosts[name]
+	}
+	m.mutex.Unlock()
+
+	pairNames := make([]string, 0, len(pairs.ByHost))
+	for name := range pairs.ByHost {
+		pairNames = append(pairNames, name)
+	}
+	sort.Strings(pairNames)
+	fmt.Fprintf(w, "# HELP goscon_host_conn_pairs Live sessions by backend host.\n# TYPE goscon_host_conn_pairs gauge\n")
+	for _, name := range pairNames {
+		fmt.Fprintf(w, "goscon_host_conn_pairs{host=%s} %d\n", promLabel(name), pairs.ByHost[name])
+	}
+	fmt.Fprintf(w, "# HELP goscon_host_dials_total Dials to backend hosts.\n# TYPE goscon_host_dials_total counter\n")
+	for i, name := range names {
+		fmt.Fprintf(w, "goscon_host_dials_total{host=%s} %d\n", promLabel(name), atomic.LoadInt64(&hosts[i].dials))
+	}
+	fmt.Fprintf(w, "# HELP goscon_host_dial_failures_total Failed dials to backend hosts.\n# TYPE goscon_host_dial_failures_total counter\n")
+	for i, name := range names {
+		fmt.Fprintf(w, "goscon_host_dial_failures_total{host=%s} %d\n", promLabel(name), atomic.LoadInt64(&hosts[i].dialFailures))
+	}
+	fmt.Fprintf(w, "# HELP goscon_host_bytes_total Bytes relayed, download is client to backend.\n# TYPE goscon_host_bytes_total counter\n")
+	for i, name := range names {
+		fmt.Fprintf(w, "goscon_host_bytes_total{host=%s,direction=\"download\"} %d\n", promLabel(name), atomic.LoadInt64(&hosts[i].download))
+		fmt.Fprintf(w, "goscon_host_bytes_total{host=%s,direction=\"upload\"} %d\n", promLabel(name), atomic.LoadInt64(&hosts[i].upload))
+	}
+}
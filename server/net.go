@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+type (
+	// Listener 监听器
+	Listener interface {
+		Accept() (Conn, error)
+		Close() error
+		Addr() net.Addr
+	}
+
+	// Conn 封装kcp和tcp的接口
+	Conn interface {
+		SetOptions(*Options)
+		GetConn() net.Conn
+	}
+
+	// TransportOptions 单个传输层(tcp/kcp)的选项
+	TransportOptions struct {
+		SentCacheSize int    // 0 means scp.SentCacheSize
+		DSCP          int    // 0 means os default
+		Iface         string // network interface to bind, empty means unbound
+	}
+
+	// KCPOptions kcp会话的参数，0表示kcp的默认值
+	KCPOptions struct {
+		NoDelay  int // 1 enables nodelay mode
+		Interval int // milliseconds between internal updates
+		Resend   int // fast resend after this many acks skipped a packet, 0 means disabled
+		NC       int // 1 disables congestion control
+		SndWnd   int // send window in packets
+		RcvWnd   int // receive window in packets
+		MTU      int // max bytes of a udp packet, up to KCPMaxMTU
+	}
+
+	// Options 服务器的选项
+	Options struct {
+		Timeout        int  // seconds to wait for reconnection of a session
+		FecData        int  // kcp fec data shards
+		FecParity      int  // kcp fec parity shards
+		MaxGoroutines  int  // refuse new connections above this, 0 means no limit
+		MaxConns       int  // refuse new sessions above this, reconnections are not counted, 0 means no limit
+		WriteTimeout   int  // seconds, close session if a relay write blocks longer, 0 means no timeout
+		IdleTimeout    int  // seconds, close session if no bytes relayed in either direction, 0 means no timeout
+		MaxFrame       int  // max bytes of one relay write, which relays one read of up to scp.NetBufferSize, 0 means unlimited
+		SentCacheMin   int  // min sent cache size granted to client requests
+		SentCacheMax   int  // max sent cache size granted to client requests, 0 means requests are ignored
+		SplitFrame     bool // split oversized frames instead of closing session
+		ReconnectWarn  int  // flag sessions reconnected this many times, 0 means disabled
+		SampleInterval int  // milliseconds between relay state samples, 0 means disabled
+
+		UploadMinPacket int // bytes of backend data gathered before relaying to client, 0 means disabled, overridden by hosts
+		UploadMaxDelay  int // milliseconds to wait for UploadMinPacket, overridden by hosts
+
+		GlobalAcceptRate int // new sessions per second, reconnections bypass it, 0 means unlimited
+		AcceptMaxDelay   int // milliseconds a new session may be delayed by GlobalAcceptRate, rejected beyond it, 0 rejects any delay
+
+		Instance string // prefix of session ids, unique across instances
+
+		IPTableSize   int    // max entries of per ip state, 0 means unlimited
+		IPTablePolicy string // IPTableOpen or IPTableClosed
+
+		HandshakeTimeout int // seconds of each handshake read, 0 means no timeout
+		HandshakeRetries int // retries of handshake reads failed by temporary errors
+
+		AcceptLoops    int  // accept goroutines per listener, each on its own reuseport socket where supported
+		AcceptAffinity bool // bind accept loops to cpus
+
+		ReconnectIP      string // ReconnectIPAny, ReconnectIPSame or ReconnectIPSubnet
+		ReconnectSubnet  int    // ipv4 prefix length for ReconnectIPSubnet
+		ReconnectSubnet6 int    // ipv6 prefix length for ReconnectIPSubnet
+
+		Metrics bool // collect metrics served by the control server
+
+		TCP       TransportOptions
+		KCP       TransportOptions
+		KCPTuning KCPOptions
+	}
+
+	tcpListener struct {
+		ln *net.TCPListener
+	}
+
+	kcpListener struct {
+		ln     *kcp.Listener
+		tuning KCPOptions
+	}
+
+	tcpConn struct {
+		conn *net.TCPConn
+	}
+
+	kcpConn struct {
+		conn *kcp.UDPSession
+	}
+)
+
+// KCPMaxMTU is the largest mtu of kcp sessions
+const KCPMaxMTU = 1500
+
+// apply sets non-zero parameters on conn, others keep kcp defaults
+func (o *KCPOptions) apply(conn *kcp.UDPSession) {
+	if o.NoDelay != 0 || o.Interval != 0 || o.Resend != 0 || o.NC != 0 {
+		interval := o.Interval
+		if interval == 0 {
+			interval = -1 // unchanged
+		}
+		conn.SetNoDelay(o.NoDelay, interval, o.Resend, o.NC)
+	}
+	if o.SndWnd != 0 || o.RcvWnd != 0 {
+		conn.SetWindowSize(o.SndWnd, o.RcvWnd) // 0 is unchanged
+	}
+	if o.MTU != 0 {
+		conn.SetMtu(o.MTU)
+	}
+}
+
+// reconnectIP policies, which source ips may reconnect a session
+const (
+	ReconnectIPAny    = "any"
+	ReconnectIPSame   = "same"   // same ip as the last connection
+	ReconnectIPSubnet = "subnet" // same subnet as the last connection
+)
+
+func (o *Options) transport(network string) *TransportOptions {
+	if network == "kcp" {
+		return &o.KCP
+	}
+	return &o.TCP
+}
+
+// listenLoops returns a listener for each of n accept loops, tcp listeners are
+// separate reuseport sockets where supported, otherwise loops share a listener
+func listenLoops(network, laddr string, options *Options, n int) ([]Listener, error) {
+	lns := make([]Listener, n)
+	if network != "tcp" || !reuseportSupported || n == 1 {
+		ln, err := ListenWithOptions(network, laddr, options)
+		if err != nil {
+			return nil, err
+		}
+		for i := range lns {
+			lns[i] = ln
+		}
+		return lns, nil
+	}
+
+	for i := range lns {
+		ln, err := listenTCP(laddr, &options.TCP, true)
+		if i == 0 && err == nil {
+			laddr = ln.Addr().String() // the same port for all if laddr has port 0
+		}
+		if err != nil {
+			for _, l := range lns[:i] {
+				l.(tcpListener).ln.Close()
+			}
+			return nil, err
+		}
+		lns[i] = tcpListener{ln: ln}
+	}
+	return lns, nil
+}
+
+var ErrBindDeviceUnsupported = errors.New("binding to interface unsupported on this platform")
+
+// listenControl applies socket options of transport to listening sockets
+func (o *TransportOptions) listenControl(c syscall.RawConn) error {
+	if o.Iface != "" {
+		return bindToDevice(c, o.Iface)
+	}
+	return nil
+}
+
+func listenTCP(laddr string, options *TransportOptions, reuseport bool) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if reuseport {
+				if err := setReuseport(network, address, c); err != nil {
+					return err
+				}
+			}
+			return options.listenControl(c)
+		},
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+func ListenWithOptions(network, laddr string, options *Options) (Listener, error) {
+	if network == "tcp" {
+		ln, err := listenTCP(laddr, &options.TCP, false)
+		if err != nil {
+			return nil, err
+		}
+		return tcpListener{ln: ln}, nil
+	}
+
+	// kcp
+	var ln *kcp.Listener
+	var err error
+	if options.KCP.Iface == "" {
+		ln, err = kcp.ListenWithOptions(laddr, nil, options.FecData, options.FecParity)
+	} else {
+		lc := net.ListenConfig{
+			Control: func(network, address string, c syscall.RawConn) error {
+				return options.KCP.listenControl(c)
+			},
+		}
+		var conn net.PacketConn
+		if conn, err = lc.ListenPacket(context.Background(), "udp", laddr); err == nil {
+			ln, err = kcp.ServeConn(nil, options.FecData, options.FecParity, conn)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dscp := options.KCP.DSCP; dscp > 0 {
+		if err := ln.SetDSCP(dscp); err != nil {
+			Error("set kcp dscp failed: %s", err.Error())
+		}
+	}
+	return kcpListener{ln: ln, tuning: options.KCPTuning}, nil
+}
+
+// addrIP returns the ip part of a tcp or udp address
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func setConnDSCP(conn *net.TCPConn, dscp int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setDSCP(raw, addrFamily(conn.LocalAddr()) == "ipv6", dscp)
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// addrFamily returns address family of a tcp or udp address
+func addrFamily(addr net.Addr) string {
+	return ipFamily(net.ParseIP(addrIP(addr)))
+}
+
+func (t tcpListener) Accept() (Conn, error) {
+	conn, err := t.ln.AcceptTCP()
+	return tcpConn{conn: conn}, err
+}
+
+func (k kcpListener) Accept() (Conn, error) {
+	conn, err := k.ln.AcceptKCP()
+	if err == nil {
+		k.tuning.apply(conn)
+	}
+	return kcpConn{conn: conn}, err
+}
+
+func (t tcpListener) Addr() net.Addr {
+	return t.ln.Addr()
+}
+
+func (k kcpListener) Addr() net.Addr {
+	return k.ln.Addr()
+}
+
+func (t tcpListener) Close() error {
+	return t.ln.Close()
+}
+
+func (k kcpListener) Close() error {
+	return k.ln.Close()
+}
+
+func (t tcpConn) SetOptions(options *Options) {
+	t.conn.SetKeepAlive(true)
+	t.conn.SetKeepAlivePeriod(time.Second * 60)
+	t.conn.SetLinger(0)
+	if dscp := options.TCP.DSCP; dscp > 0 {
+		if err := setConnDSCP(t.conn, dscp); err != nil {
+			Error("set tcp dscp failed: %s", err.Error())
+		}
+	}
+}
+
+func (t tcpConn) GetConn() net.Conn {
+	return t.conn
+}
+
+func (k kcpConn) SetOptions(options *Options) {
+
+}
+
+func (k kcpConn) GetConn() net.Conn {
+	return k.conn
+}
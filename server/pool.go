@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	warmPoolRefill = time.Second      // interval of topping up pools
+	warmPoolMaxAge = 30 * time.Second // pooled conns older are closed, backends may drop idle conns
+)
+
+type pooledConn struct {
+	conn   *net.TCPConn
+	dialed time.Time
+}
+
+// warmPool is pre-dialed connections of a host, newest last
+type warmPool struct {
+	sync.Mutex
+	conns   []pooledConn
+	retired bool // the host is removed, refuse new conns
+}
+
+// take returns the newest conn dialed within warmPoolMaxAge, nil if none
+func (p *warmPool) take(now time.Time) *net.TCPConn {
+	p.Lock()
+	defer p.Unlock()
+	p.expireLocked(now)
+	n := len(p.conns)
+	if n == 0 {
+		return nil
+	}
+	conn := p.conns[n-1].conn
+	p.conns = p.conns[:n-1]
+	return conn
+}
+
+// put adds conn if the pool has less than max conns
+func (p *warmPool) put(conn *net.TCPConn, dialed time.Time, max int) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.retired || len(p.conns) >= max {
+		return false
+	}
+	p.conns = append(p.conns, pooledConn{conn: conn, dialed: dialed})
+	return true
+}
+
+func (p *warmPool) expire(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.expireLocked(now)
+}
+
+func (p *warmPool) expireLocked(now time.Time) {
+	i := 0
+	for ; i < len(p.conns) && now.Sub(p.conns[i].dialed) >= warmPoolMaxAge; i++ {
+		p.conns[i].conn.Close()
+	}
+	p.conns = append(p.conns[:0], p.conns[i:]...)
+}
+
+// drain closes all pooled conns
+func (p *warmPool) drain() {
+	p.Lock()
+	defer p.Unlock()
+	for _, c := range p.conns {
+		c.conn.Close()
+	}
+	p.conns = nil
+}
+
+// retire drains the pool for good
+func (p *warmPool) retire() {
+	p.drain()
+	p.Lock()
+	p.retired = true
+	p.Unlock()
+}
+
+func (p *warmPool) size() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.conns)
+}
+
+// takePooled returns a pre-dialed conn of host, nil if none or host is down
+func (tp *LocalConnProvider) takePooled(host *Host) *net.TCPConn {
+	if tp.WarmPool <= 0 || host.state.isDown() {
+		return nil
+	}
+	conn := host.state.pool.take(time.Now())
+	if conn != nil {
+		atomic.AddInt64(&tp.poolHits, 1)
+		tp.wakePools()
+	}
+	return conn
+}
+
+// wakePools asks fillPools to top up now
+func (tp *LocalConnProvider) wakePools() {
+	select {
+	case tp.poolWake <- struct{}{}:
+	default:
+	}
+}
+
+// fillPools keeps WarmPool pre-dialed conns to every healthy host of the
+// running config until tp is closed
+func (tp *LocalConnProvider) fillPools() {
+	for {
+		tp.Lock()
+		hosts := tp.hosts
+		tp.Unlock()
+		for i := range hosts {
+			if hosts[i].Drain {
+				hosts[i].state.pool.drain()
+				continue
+			}
+			tp.fillPool(&hosts[i])
+		}
+
+		select {
+		case <-tp.poolWake:
+		case <-time.After(warmPoolRefill):
+		case <-tp.closed:
+			tp.resetMutex.Lock()
+			for _, state := range tp.states {
+				state.pool.retire()
+			}
+			tp.resetMutex.Unlock()
+			return
+		}
+	}
+}
+
+// fillPool dials host until its pool is full, stops at the first failure
+func (tp *LocalConnProvider) fillPool(host *Host) {
+	dial := tp.dial
+	if dial == nil {
+		dial = tp.dialHost
+	}
+	host.state.pool.expire(time.Now())
+	for host.state.pool.size() < tp.WarmPool && !host.state.isDown() {
+		conn, err := dial(host, host.dialTimeout, nil)
+		if err != nil {
+			Debug("warm pool dial host %s(%s) failed: %s", host.Name, host.addr, err.Error())
+			return
+		}
+		if !host.state.pool.put(conn, time.Now(), tp.WarmPool) {
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (tp *LocalConnProvider) NumOfPoolHits() int64 {
+	return atomic.LoadInt64(&tp.poolHits)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWarmPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	tp := NewLocalConnProvider("")
+	tp.WarmPool = 2
+	config := &Config{Hosts: []Host{{Addr: ln.Addr().String(), Name: "a", Weight: 10}}}
+	if err := tp.reset(config); err != nil {
+		t.Fatal(err)
+	}
+	host := &tp.hosts[0]
+	tp.fillPool(host)
+	if n := host.state.pool.size(); n != 2 {
+		t.Fatalf("pool size %d, expected 2", n)
+	}
+
+	conn, _, err := tp.CreateLocalConn(remoteConnTo("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if tp.NumOfPoolHits() != 1 || host.state.pool.size() != 1 {
+		t.Errorf("pool hits %d, size %d", tp.NumOfPoolHits(), host.state.pool.size())
+	}
+
+	// down hosts hand out nothing, stale conns are dropped
+	host.state.setDown(true)
+	if tp.takePooled(host) != nil {
+		t.Error("pooled conn of a down host")
+	}
+	host.state.setDown(false)
+	host.state.pool.expire(time.Now().Add(warmPoolMaxAge))
+	if n := host.state.pool.size(); n != 0 {
+		t.Errorf("%d stale conns kept", n)
+	}
+
+	// a reload moving the host to another addr retires its pool
+	tp.fillPool(host)
+	old := host.state
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	config = &Config{Hosts: []Host{{Addr: net.JoinHostPort("127.0.0.2", port), Name: "a", Weight: 10}}}
+	if err := tp.reset(config); err != nil {
+		t.Fatal(err)
+	}
+	if old.pool.size() != 0 || old.pool.put(nil, time.Now(), 2) {
+		t.Error("pool of the old addr not retired")
+	}
+	for len(accepted) > 0 {
+		(<-accepted).Close()
+	}
+}
@@ -0,0 +1,1119 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+var errNoHost = errors.New("no host")
+var errHostFull = errors.New("host full")
+var errRateLimited = errors.New("rate limited")
+
+type Host struct {
+	Addr          string            `json:"addr"`
+	Weight        int               `json:"weight"`
+	Name          string            `json:"name"`
+	Drain         bool              `json:"drain"`                // excluded from new sessions, existing ones stay and reconnect
+	AddressFamily string            `json:"address_family"`       // overrides Config.AddressFamily
+	Srv           string            `json:"srv"`                  // srv name, expanded to hosts of its targets
+	Priority      int               `json:"priority"`             // only hosts of the lowest priority are selected by weight
+	Proxy         *ProxyConfig      `json:"proxy"`                // overrides Config.Proxy
+	Labels        map[string]string `json:"labels"`               // attached to logs of sessions on this host
+	MaxConns      int               `json:"max_conns"`            // excluded from selection when reached, 0 means no limit
+	Interface     string            `json:"interface"`            // overrides Config.Interface
+	DialTimeoutMs int               `json:"dial_timeout_ms"`      // overrides Config.DialTimeoutMs if not 0
+	KeepaliveSec  int               `json:"keepalive_sec"`        // overrides Config.KeepaliveSec if not 0
+	TLS           bool              `json:"tls"`                  // dial over tls, Name is the server name if set
+	TLSCA         string            `json:"tls_ca"`               // pem file of ca certificates, system roots if empty
+	TLSSkipVerify bool              `json:"insecure_skip_verify"` // don't verify certificate of the host
+
+	MaxNewConnsPerSec      int `json:"max_new_conns_per_sec"`        // new sessions to Name per second, 0 means no limit
+	MaxNewConnsPerIPPerSec int `json:"max_new_conns_per_ip_per_sec"` // new sessions to Name per second of each client ip
+
+	UploadMinPacket *int `json:"upload_min_packet"` // overrides Options.UploadMinPacket if set, 0 means no batching
+	UploadMaxDelay  *int `json:"upload_max_delay"`  // milliseconds, overrides Options.UploadMaxDelay if set
+
+	addr    *net.TCPAddr
+	srv     string         // srv name this host expanded from
+	proxy   *ProxyConfig   // effective proxy, nil means direct
+	iface   string         // effective interface, empty means unbound
+	labels  string         // formatted labels for logs
+	state   *hostState     // shared by copies of the host
+	limiter *targetLimiter // shared by hosts of Name, nil if unlimited
+
+	tlsConfig   *tls.Config   // nil if not tls
+	labelFields []LogField    // labels as fields of structured logs
+	dialTimeout time.Duration // effective dial timeout, 0 means no timeout
+	keepalive   time.Duration // effective keepalive period, 0 means dialer default
+}
+
+type Config struct {
+	Hosts         []Host       `json:"hosts"`
+	AddressFamily string       `json:"address_family"` // ipv4, ipv6 or auto(default)
+	SrvRefresh    int          `json:"srv_refresh"`    // seconds between srv lookups, 0 means only on reload
+	SrvStrict     bool         `json:"srv_strict"`     // fail instead of keeping last known targets if srv lookup failed
+	Proxy         *ProxyConfig `json:"proxy"`          // dial backends through http CONNECT proxy
+	Interface     string       `json:"interface"`      // network interface of backend dials, empty means os routing
+
+	HealthInterval int `json:"health_interval"` // seconds between health checks, 0 means disabled
+	HealthTimeout  int `json:"health_timeout"`  // seconds of health check dials, 3 if 0
+	DialAttempts   int `json:"dial_attempts"`   // hosts tried for a session, 3 if 0
+	DialTimeoutMs  int `json:"dial_timeout_ms"` // milliseconds of backend dials, 0 means no timeout
+	KeepaliveSec   int `json:"keepalive_sec"`   // tcp keepalive period of backend connections, 0 means dialer default
+
+	MinHosts          int    `json:"min_hosts"`           // refuse config with fewer weighted hosts
+	RemovedHostPolicy string `json:"removed_host_policy"` // keep(default) or terminate sessions on removed hosts
+
+	Allow []string `json:"allow"` // cidrs of clients admitted, empty means all
+	Deny  []string `json:"deny"`  // cidrs of clients refused, wins over allow
+	Token string   `json:"token"` // shared secret required of new sessions, empty means not checked
+}
+
+const (
+	removedHostKeep      = "keep"
+	removedHostTerminate = "terminate"
+)
+
+// formatLabels formats labels as {k1=v1,k2=v2} sorted by key
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + labels[k]
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelFields returns labels as log fields of keys label.k sorted by key
+func labelFields(labels map[string]string) []LogField {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]LogField, len(keys))
+	for i, k := range keys {
+		fields[i] = LogField{"label." + k, labels[k]}
+	}
+	return fields
+}
+
+// TCPAddr returns the resolved address of host
+func (host *Host) TCPAddr() *net.TCPAddr {
+	return host.addr
+}
+
+// key identifies a host across reloads
+func (host *Host) key() string {
+	return host.Name + "@" + host.addr.String()
+}
+
+// resolveNetwork maps address family option to network for resolving
+func resolveNetwork(family string) (string, error) {
+	switch family {
+	case "", "auto":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("invalid address_family: %s", family)
+}
+
+// LocalConnWrapper transforms backend connections, local is a tls conn for tls hosts
+type LocalConnWrapper interface {
+	Wrapper(local HalfCloseConn, remote net.Conn) (HalfCloseConn, error)
+}
+
+type LocalConnProvider struct {
+	hostsRejected int64 // configs refused by MaxHosts, atomic
+	dialRetries   int64 // dials retried on another host, atomic
+	rateLimited   int64 // sessions denied by max_new_conns_per_sec, atomic
+	poolHits      int64 // sessions served by warm pool conns, atomic
+
+	sync.Mutex
+	hosts []Host
+
+	resetMutex sync.Mutex                // serializes reset
+	config     *Config                   // running config
+	states     map[string]*hostState     // by host key
+	limiters   map[string]*targetLimiter // by host name
+	acl        *accessList               // nil admits every client
+	srvCache   map[string][]*net.SRV     // last known srv records, guarded by resetMutex
+
+	wrapper LocalConnWrapper
+
+	// resolves srv records, net.LookupSRV if nil
+	lookupSRV func(name string) ([]*net.SRV, error)
+
+	// connects to backend hosts, dialHost if nil
+	dial func(host *Host, timeout time.Duration, params *sockParams) (*net.TCPConn, error)
+
+	metrics *metrics // nil if disabled
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	closed    chan struct{} // stops background refreshes
+	poolWake  chan struct{} // wakes fillPools after a pooled conn is taken
+
+	// called with keys of removed hosts if removed_host_policy is terminate
+	onHostsRemoved func(keys map[string]bool)
+
+	ConfigFile string
+	Warmup     bool // pre-dial every host after loading config
+	DSCP       int  // dscp of backend connections, 0 means os default
+	DialWindow int  // number of recent dials for failure ratio
+	MaxHosts   int  // refuse config with more hosts, 0 means no limit
+	WarmPool   int  // pre-dialed conns kept for every host, 0 means disabled
+	Propagate  int  // mask of client socket parameters applied on backend connections
+
+	ProxyProtocol string // PROXY protocol header written to backend connections, ProxyProtocolOff if empty
+
+	IPTableSize   int    // max source ips tracked by every rate limited name, 0 means unlimited
+	IPTablePolicy string // IPTableOpen or IPTableClosed
+}
+
+// dialControl applies socket options to backend connections before connecting
+func (tp *LocalConnProvider) dialControl(network, address string, c syscall.RawConn) error {
+	if tp.DSCP > 0 {
+		if err := setDSCP(c, network == "tcp6", tp.DSCP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const warmupDialTimeout = 3 * time.Second
+
+// warmup dials every host as sessions do and closes at once, so unreachable
+// backends are reported before real traffic arrives, and marked down before
+// the first health check if health is checked
+func (tp *LocalConnProvider) warmup(hosts []Host, health bool) {
+	for i := range hosts {
+		host := &hosts[i]
+		start := time.Now()
+		conn, err := tp.dialHost(host, warmupDialTimeout, nil)
+		if health && host.state.setDown(err != nil) && err != nil {
+			host.state.pool.drain()
+		}
+		if err != nil {
+			Error("warmup host %s(%s) failed: %s", host.Name, host.addr, err.Error())
+			continue
+		}
+		conn.Close()
+		Info("warmup host %s(%s) ok in %v", host.Name, host.addr, time.Since(start))
+	}
+}
+
+func (tp *LocalConnProvider) MustSetWrapper(wrapper LocalConnWrapper) {
+	if tp.wrapper != nil {
+		panic("tp.wrapper != nil")
+	}
+	tp.wrapper = wrapper
+}
+
+// GetHostByWeight selects a host by weight of the lowest priority that has
+// available hosts, hosts at max_conns are excluded and others absorb their
+// share, a higher priority takes over when all hosts of lower ones are out
+func (tp *LocalConnProvider) GetHostByWeight() *Host {
+	return tp.getHostByWeight(nil)
+}
+
+// weighted reports whether host can take a session selected by weight
+func (host *Host) weighted() bool {
+	return host.Weight > 0 && !host.Drain && !host.state.isDown() && !host.state.full(host.MaxConns)
+}
+
+// activePriority returns the lowest priority of weighted hosts whose addr is
+// not in tried, false if there is none
+func activePriority(hosts []Host, tried map[string]bool) (int, bool) {
+	priority, found := 0, false
+	for i := range hosts {
+		host := &hosts[i]
+		if !host.weighted() || tried[host.addr.String()] {
+			continue
+		}
+		if !found || host.Priority < priority {
+			priority, found = host.Priority, true
+		}
+	}
+	return priority, found
+}
+
+// getHostByWeight selects by weight among hosts whose addr is not in tried
+func (tp *LocalConnProvider) getHostByWeight(tried map[string]bool) *Host {
+	// reloads and srv refreshes swap tp.hosts, select from the current one
+	tp.Lock()
+	hosts := tp.hosts
+	tp.Unlock()
+
+	priority, ok := activePriority(hosts, tried)
+	if !ok {
+		return nil
+	}
+	weight := 0
+	available := make([]bool, len(hosts))
+	for i, host := range hosts {
+		if host.Priority != priority || !host.weighted() || tried[host.addr.String()] {
+			continue
+		}
+		available[i] = true
+		weight += host.Weight
+	}
+	if weight == 0 {
+		return nil
+	}
+	// v falls in [0, weight), each host owns a range of its weight
+	v := rand.Intn(weight)
+	for i, host := range hosts {
+		if !available[i] {
+			continue
+		}
+		if v < host.Weight {
+			return &host
+		}
+		v -= host.Weight
+	}
+	return nil
+}
+
+// GetHostByName selects a healthy host of name, hosts of weight 0 included,
+// falls back to weighted selection if all hosts of name are down or draining
+func (tp *LocalConnProvider) GetHostByName(name string) *Host {
+	return tp.getHostByName(name, nil)
+}
+
+// getHostByName selects a host of name whose addr is not in tried, retries
+// never fall back to other names as the client asked for this one
+func (tp *LocalConnProvider) getHostByName(name string, tried map[string]bool) *Host {
+	tp.Lock()
+	hosts := tp.hosts
+	tp.Unlock()
+
+	found := false
+	for _, host := range hosts {
+		if host.Name == name && !tried[host.addr.String()] {
+			if host.Drain || host.state.isDown() {
+				found = true
+				continue
+			}
+			return &host
+		}
+	}
+	if len(tried) > 0 {
+		return nil
+	}
+	if found {
+		Log("GetHostByName: %s is down or draining, select by weight", name)
+		return tp.GetHostByWeight()
+	}
+	Log("GetHostByName failed: %s", tp.missingName(name).Error())
+	return nil
+}
+
+// maxListedNames limits known names listed in a hostNameError
+const maxListedNames = 20
+
+// hostNameError tells that no host has the name a client asked for, it is
+// errNoHost with the known names
+type hostNameError struct {
+	name  string
+	known []string
+	more  int // known names not listed
+}
+
+func (e *hostNameError) Error() string {
+	known := strings.Join(e.known, ", ")
+	if e.more > 0 {
+		known += fmt.Sprintf(" and %d more", e.more)
+	}
+	return fmt.Sprintf("no host named %s, known names: %s", e.name, known)
+}
+
+func (e *hostNameError) Unwrap() error {
+	return errNoHost
+}
+
+// missingName returns a *hostNameError if no host has name, nil otherwise
+func (tp *LocalConnProvider) missingName(name string) error {
+	tp.Lock()
+	hosts := tp.hosts
+	tp.Unlock()
+
+	names := make(map[string]bool)
+	for _, host := range hosts {
+		if host.Name == name {
+			return nil
+		}
+		if host.Name != "" {
+			names[host.Name] = true
+		}
+	}
+	e := &hostNameError{name: name}
+	for n := range names {
+		e.known = append(e.known, n)
+	}
+	sort.Strings(e.known)
+	if len(e.known) > maxListedNames {
+		e.more = len(e.known) - maxListedNames
+		e.known = e.known[:maxListedNames]
+	}
+	return e
+}
+
+func (tp *LocalConnProvider) GetHost(preferred string) *Host {
+	return tp.getHost(preferred, nil)
+}
+
+func (tp *LocalConnProvider) getHost(preferred string, tried map[string]bool) *Host {
+	if preferred == "" {
+		return tp.getHostByWeight(tried)
+	} else {
+		return tp.getHostByName(preferred, tried)
+	}
+}
+
+// dialHost connects to host directly or through its proxy, timeout 0 means os default
+func (tp *LocalConnProvider) dialHost(host *Host, timeout time.Duration, params *sockParams) (*net.TCPConn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: host.keepalive, Control: tp.dialControl}
+	if params != nil || host.iface != "" {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if err := tp.dialControl(network, address, c); err != nil {
+				return err
+			}
+			if host.iface != "" {
+				if err := bindToDevice(c, host.iface); err != nil {
+					return err
+				}
+			}
+			if params != nil {
+				return params.control(c)
+			}
+			return nil
+		}
+	}
+	if host.proxy != nil {
+		return dialHTTPProxy(dialer, host.proxy, host.Addr)
+	}
+	c, err := dialer.Dial("tcp", host.addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.TCPConn), nil
+}
+
+const defaultDialAttempts = 3
+
+// CreateLocalConn connects a backend host for remoteConn, a failed host is
+// retried on another one up to dial_attempts hosts
+func (tp *LocalConnProvider) CreateLocalConn(remoteConn *scp.Conn) (HalfCloseConn, *Host, error) {
+	return tp.createLocalConn(remoteConn, nil)
+}
+
+// createLocalConn is CreateLocalConn logging with context of the session
+func (tp *LocalConnProvider) createLocalConn(remoteConn *scp.Conn, log *connLogger) (HalfCloseConn, *Host, error) {
+	tp.Lock()
+	config := tp.config
+	tp.Unlock()
+	if config == nil {
+		// not loaded yet, there is no host to connect
+		return nil, nil, errNoHost
+	}
+	attempts := config.DialAttempts
+	if attempts <= 0 {
+		attempts = defaultDialAttempts
+	}
+
+	var params *sockParams
+	if tp.Propagate != 0 {
+		var err error
+		if params, err = clientSockParams(remoteConn.RawConn(), tp.Propagate); err != nil {
+			log.Error("read client socket parameters failed: %s", err.Error())
+		}
+	}
+
+	target := remoteConn.TargetServer()
+	tried := make(map[string]bool)
+	err := errNoHost
+	for i := 0; i < attempts; i++ {
+		host := tp.getHost(target, tried)
+		if host == nil {
+			if i == 0 && target != "" {
+				if e := tp.missingName(target); e != nil {
+					err = e
+				}
+			}
+			break
+		}
+		if i > 0 {
+			atomic.AddInt64(&tp.dialRetries, 1)
+		}
+		tried[host.addr.String()] = true
+
+		var conn HalfCloseConn
+		hostLog := log.with(LogField{"host", host.Name}, LogField{"backend", host.addr.String()})
+		if conn, err = tp.connectHost(host, remoteConn, params, hostLog); err == nil {
+			return conn, host, nil
+		}
+		hostLog.Error("connect host %s(%s) failed, attempt %d/%d: %s", host.Name, host.addr, i+1, attempts, err.Error())
+		if err == errRateLimited && target != "" {
+			break // other hosts of the name share the limit
+		}
+	}
+	return nil, nil, err
+}
+
+// connectHost dials host and wraps the connection for remoteConn
+func (tp *LocalConnProvider) connectHost(host *Host, remoteConn *scp.Conn, params *sockParams, log *connLogger) (HalfCloseConn, error) {
+	if host.limiter != nil && !host.limiter.allow(addrIP(remoteConn.RemoteAddr()), time.Now()) {
+		atomic.AddInt64(&tp.rateLimited, 1)
+		return nil, errRateLimited
+	}
+	if !host.state.acquireConn(host.MaxConns) {
+		return nil, errHostFull
+	}
+
+	log.Debug("dial host %s(%s) via %s", host.Name, host.addr, ipFamily(host.addr.IP))
+	dial := tp.dial
+	if dial == nil {
+		dial = tp.dialHost
+	}
+	var local HalfCloseConn
+	var conn *net.TCPConn
+	var err error
+	// socket parameters of the client must be set before connecting
+	if params == nil {
+		conn = tp.takePooled(host)
+	}
+	if conn == nil {
+		conn, err = dial(host, host.dialTimeout, params)
+	}
+	if err == nil {
+		local, err = tp.prepareConn(host, conn, remoteConn, params, log)
+	}
+	host.state.recordDial(err != nil)
+	tp.metrics.recordDial(host.Name, err != nil)
+	if err != nil {
+		host.state.releaseConn()
+		return nil, err
+	}
+
+	if tp.wrapper == nil {
+		return local, nil
+	}
+
+	newConn, err := tp.wrapper.Wrapper(local, remoteConn)
+	if err != nil {
+		local.Close()
+		host.state.releaseConn()
+		return nil, err
+	}
+
+	return newConn, nil
+}
+
+// prepareConn applies socket parameters, PROXY protocol header and tls on a
+// dialed conn, conn is closed on failure
+func (tp *LocalConnProvider) prepareConn(host *Host, conn *net.TCPConn, remoteConn *scp.Conn, params *sockParams, log *connLogger) (HalfCloseConn, error) {
+	if params != nil {
+		if err := params.apply(conn); err != nil {
+			log.Error("apply client socket parameters failed: %s", err.Error())
+		}
+	}
+
+	// the header is in plain text before tls and wrapper data
+	if tp.ProxyProtocol != "" && tp.ProxyProtocol != ProxyProtocolOff {
+		if err := writeProxyHeader(conn, tp.ProxyProtocol, remoteConn.RemoteAddr(), remoteConn.LocalAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if host.tlsConfig == nil {
+		return conn, nil
+	}
+	return tlsClient(conn, host.tlsConfig, host.dialTimeout)
+}
+
+// ConfigError lists every problem found in a config
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%d problems: %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// loadedConfig is a validated config ready to run
+type loadedConfig struct {
+	config   *Config
+	hosts    []Host
+	states   map[string]*hostState
+	limiters map[string]*targetLimiter
+	acl      *accessList
+	warnings []string // not worth refusing the config
+}
+
+func (tp *LocalConnProvider) reset(config *Config) error {
+	tp.resetMutex.Lock()
+	defer tp.resetMutex.Unlock()
+	return tp.resetLocked(config)
+}
+
+// resetLocked runs config if valid, callers hold resetMutex
+func (tp *LocalConnProvider) resetLocked(config *Config) error {
+	loaded, err := tp.load(config)
+	if err != nil {
+		return err
+	}
+	hosts := loaded.hosts
+
+	tp.Lock()
+	oldHosts, oldStates, oldConfig := tp.hosts, tp.states, tp.config
+	tp.hosts = hosts
+	tp.config = config
+	tp.states = loaded.states
+	tp.limiters = loaded.limiters
+	tp.acl = loaded.acl
+	tp.Unlock()
+
+	// srv refreshes run the same config again, warn once per config
+	if config != oldConfig {
+		for _, warning := range loaded.warnings {
+			Log("config warning: %s", warning)
+		}
+	}
+
+	// pools of removed hosts, or hosts of changed address, are not used any more
+	for key, state := range oldStates {
+		if loaded.states[key] != state {
+			state.pool.retire()
+		}
+	}
+
+	if config.RemovedHostPolicy == removedHostTerminate && tp.onHostsRemoved != nil {
+		removed := make(map[string]bool)
+		for i := range oldHosts {
+			removed[oldHosts[i].key()] = true
+		}
+		for i := range hosts {
+			delete(removed, hosts[i].key())
+		}
+		if len(removed) > 0 {
+			tp.onHostsRemoved(removed)
+		}
+	}
+	return nil
+}
+
+// load validates config as a whole without touching the running one, every
+// problem is reported in a *ConfigError. Callers hold resetMutex.
+func (tp *LocalConnProvider) load(config *Config) (*loadedConfig, error) {
+	var problems []string
+	hosts, err := tp.expandHosts(config)
+	if err != nil {
+		if e, ok := err.(*ConfigError); ok {
+			problems = append(problems, e.Problems...)
+		} else {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if tp.MaxHosts > 0 && len(hosts) > tp.MaxHosts {
+		atomic.AddInt64(&tp.hostsRejected, 1)
+		problems = append(problems, fmt.Sprintf("%d hosts exceed max hosts %d", len(hosts), tp.MaxHosts))
+	}
+
+	seen := make(map[string]bool)
+	for i := range hosts {
+		host := &hosts[i]
+		if problem := setupHost(host, config); problem != "" {
+			problems = append(problems, problem)
+			continue
+		}
+		// hosts of a name with different addresses are a group, the same
+		// address twice would share state and double its weight
+		if key := host.key(); seen[key] {
+			problems = append(problems, fmt.Sprintf("host %s: duplicate addr %s", host.Name, host.addr))
+		} else {
+			seen[key] = true
+		}
+	}
+
+	switch config.RemovedHostPolicy {
+	case "", removedHostKeep, removedHostTerminate:
+	default:
+		problems = append(problems, fmt.Sprintf("invalid removed_host_policy: %s", config.RemovedHostPolicy))
+	}
+
+	limiters, err := tp.buildLimiters(hosts)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	acl, aclProblems := newAccessList(config.Allow, config.Deny)
+	problems = append(problems, aclProblems...)
+
+	weighted := 0
+	for i := range hosts {
+		if hosts[i].Weight > 0 && !hosts[i].Drain {
+			weighted++
+		}
+	}
+
+	if weighted == 0 {
+		problems = append(problems, "no hosts")
+	}
+
+	// safe mode: keep running config rather than shrinking below the floor
+	if weighted < config.MinHosts {
+		problems = append(problems, fmt.Sprintf("%d hosts below min_hosts %d", weighted, config.MinHosts))
+	}
+
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+
+	// keep runtime state of unchanged hosts
+	states := make(map[string]*hostState)
+	for i := range hosts {
+		host := &hosts[i]
+		key := host.key()
+		state := tp.states[key]
+		if state == nil {
+			state = newHostState(tp.DialWindow)
+		}
+		states[key] = state
+		host.state = state
+	}
+
+	return &loadedConfig{
+		config:   config,
+		hosts:    hosts,
+		states:   states,
+		limiters: limiters,
+		acl:      acl,
+		warnings: sharedNames(hosts),
+	}, nil
+}
+
+// sharedNames warns of names configured on more than one host, such hosts
+// are a group selected one by one, which may be a copy and paste mistake.
+// Hosts expanded from srv share the name by design.
+func sharedNames(hosts []Host) []string {
+	addrs := make(map[string][]string)
+	var names []string
+	for i := range hosts {
+		host := &hosts[i]
+		if host.Name == "" || host.srv != "" {
+			continue
+		}
+		if addrs[host.Name] == nil {
+			names = append(names, host.Name)
+		}
+		addrs[host.Name] = append(addrs[host.Name], host.addr.String())
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	for _, name := range names {
+		if len(addrs[name]) > 1 {
+			warnings = append(warnings, fmt.Sprintf("host name %s is shared by %d hosts (%s), selected by name as a group",
+				name, len(addrs[name]), strings.Join(addrs[name], ", ")))
+		}
+	}
+	return warnings
+}
+
+// uploadBatching returns the upload batching of sessions on host, overrides
+// of host or minPacket and maxDelay of options
+func (host *Host) uploadBatching(minPacket, maxDelay int) (int, int) {
+	if host.UploadMinPacket != nil {
+		minPacket = *host.UploadMinPacket
+	}
+	if host.UploadMaxDelay != nil {
+		maxDelay = *host.UploadMaxDelay
+	}
+	return minPacket, maxDelay
+}
+
+// setupHost resolves host and derives its effective options from config,
+// returns the problem found if any
+func setupHost(host *Host, config *Config) string {
+	if host.Weight < 0 {
+		return fmt.Sprintf("host %s: invalid weight: %d", host.Name, host.Weight)
+	}
+	if (host.UploadMinPacket != nil && *host.UploadMinPacket < 0) || (host.UploadMaxDelay != nil && *host.UploadMaxDelay < 0) {
+		return fmt.Sprintf("host %s: invalid upload batching", host.Name)
+	}
+
+	family := host.AddressFamily
+	if family == "" {
+		family = config.AddressFamily
+	}
+	network, err := resolveNetwork(family)
+	if err != nil {
+		return fmt.Sprintf("host %s: %s", host.Name, err.Error())
+	}
+	if host.addr, err = net.ResolveTCPAddr(network, host.Addr); err != nil {
+		return fmt.Sprintf("host %s: %s", host.Name, err.Error())
+	}
+
+	host.labels = formatLabels(host.Labels)
+	host.labelFields = labelFields(host.Labels)
+
+	host.proxy = host.Proxy
+	if host.proxy == nil {
+		host.proxy = config.Proxy
+	}
+	if host.proxy != nil && host.proxy.Addr == "" {
+		return fmt.Sprintf("host %s: empty proxy addr", host.Name)
+	}
+
+	dialTimeout, keepalive := host.DialTimeoutMs, host.KeepaliveSec
+	if dialTimeout == 0 {
+		dialTimeout = config.DialTimeoutMs
+	}
+	if keepalive == 0 {
+		keepalive = config.KeepaliveSec
+	}
+	if dialTimeout < 0 {
+		return fmt.Sprintf("host %s: invalid dial_timeout_ms: %d", host.Name, dialTimeout)
+	}
+	if keepalive < 0 {
+		return fmt.Sprintf("host %s: invalid keepalive_sec: %d", host.Name, keepalive)
+	}
+	host.dialTimeout = time.Duration(dialTimeout) * time.Millisecond
+	host.keepalive = time.Duration(keepalive) * time.Second
+
+	host.tlsConfig = nil
+	if host.TLS {
+		if host.tlsConfig, err = newTLSConfig(host); err != nil {
+			return fmt.Sprintf("host %s: %s", host.Name, err.Error())
+		}
+	}
+
+	host.iface = host.Interface
+	if host.iface == "" {
+		host.iface = config.Interface
+	}
+	if host.iface != "" {
+		if !BindDeviceSupported {
+			return fmt.Sprintf("host %s: interface: %s", host.Name, ErrBindDeviceUnsupported.Error())
+		}
+		if _, err := net.InterfaceByName(host.iface); err != nil {
+			return fmt.Sprintf("host %s: interface %s: %s", host.Name, host.iface, err.Error())
+		}
+	}
+	return ""
+}
+
+// buildLimiters assigns a limiter to hosts of every rate limited name,
+// limiters of unchanged rates are kept with their buckets
+func (tp *LocalConnProvider) buildLimiters(hosts []Host) (map[string]*targetLimiter, error) {
+	limiters := make(map[string]*targetLimiter)
+	for i := range hosts {
+		host := &hosts[i]
+		if host.MaxNewConnsPerSec < 0 || host.MaxNewConnsPerIPPerSec < 0 {
+			return nil, fmt.Errorf("host %s: invalid max_new_conns_per_sec", host.Name)
+		}
+		host.limiter = nil
+		if host.MaxNewConnsPerSec == 0 && host.MaxNewConnsPerIPPerSec == 0 {
+			continue
+		}
+		l := limiters[host.Name]
+		if l == nil {
+			l = tp.limiters[host.Name]
+			if l == nil || l.rate != host.MaxNewConnsPerSec || l.ipRate != host.MaxNewConnsPerIPPerSec {
+				l = newTargetLimiter(host.MaxNewConnsPerSec, host.MaxNewConnsPerIPPerSec, tp.IPTableSize, tp.IPTablePolicy)
+			}
+			limiters[host.Name] = l
+		} else if l.rate != host.MaxNewConnsPerSec || l.ipRate != host.MaxNewConnsPerIPPerSec {
+			return nil, fmt.Errorf("host %s: conflicting max_new_conns_per_sec of the same name", host.Name)
+		}
+		host.limiter = l
+	}
+	return limiters, nil
+}
+
+type hostSnapshot struct {
+	Name            string            `json:"name"`
+	Addr            string            `json:"addr"`
+	Resolved        string            `json:"resolved"`
+	Srv             string            `json:"srv,omitempty"`
+	Weight          int               `json:"weight"`
+	EffectiveWeight int               `json:"effective_weight"` // 0 if not in the priority selected by weight, down, full or draining
+	Priority        int               `json:"priority"`
+	Labels          map[string]string `json:"labels,omitempty"`
+
+	Proxy            string  `json:"proxy,omitempty"` // proxy addr only, credentials are redacted
+	Interface        string  `json:"interface,omitempty"`
+	TLSServerName    string  `json:"tls_server_name,omitempty"` // empty if not tls
+	Down             bool    `json:"down"`
+	Drain            bool    `json:"drain,omitempty"`
+	DialFailureRatio float64 `json:"dial_failure_ratio"`
+	DialSamples      int     `json:"dial_samples"`
+	Conns            int64   `json:"conns"`
+	MaxConns         int     `json:"max_conns,omitempty"`
+	Pooled           int     `json:"pooled,omitempty"`
+
+	MaxNewConnsPerSec      int `json:"max_new_conns_per_sec,omitempty"`
+	MaxNewConnsPerIPPerSec int `json:"max_new_conns_per_ip_per_sec,omitempty"`
+
+	UploadMinPacket *int `json:"upload_min_packet,omitempty"`
+	UploadMaxDelay  *int `json:"upload_max_delay,omitempty"`
+}
+
+// configSnapshot is the effective config, secrets must never be copied into it
+type configSnapshot struct {
+	ConfigFile        string         `json:"config_file"`
+	Warmup            bool           `json:"warmup"`
+	DSCP              int            `json:"dscp"`
+	AddressFamily     string         `json:"address_family"`
+	SrvRefresh        int            `json:"srv_refresh"`
+	SrvStrict         bool           `json:"srv_strict"`
+	MinHosts          int            `json:"min_hosts"`
+	RemovedHostPolicy string         `json:"removed_host_policy"`
+	HealthInterval    int            `json:"health_interval"`
+	Allow             []string       `json:"allow,omitempty"`
+	Deny              []string       `json:"deny,omitempty"`
+	Token             bool           `json:"token"` // whether a token is required, never the token
+	Hosts             []hostSnapshot `json:"hosts"`
+}
+
+// allowClient reports whether the access list of the running config admits
+// a client from addr
+func (tp *LocalConnProvider) allowClient(addr net.Addr) bool {
+	tp.Lock()
+	acl := tp.acl
+	tp.Unlock()
+	return acl.allowed(net.ParseIP(addrIP(addr)))
+}
+
+// token returns the token required of new sessions, empty if not required
+func (tp *LocalConnProvider) token() string {
+	tp.Lock()
+	defer tp.Unlock()
+	if tp.config == nil {
+		return ""
+	}
+	return tp.config.Token
+}
+
+// Snapshot returns the running config with live state of hosts
+func (tp *LocalConnProvider) Snapshot() *configSnapshot {
+	tp.Lock()
+	defer tp.Unlock()
+
+	snapshot := &configSnapshot{
+		ConfigFile: tp.ConfigFile,
+		Warmup:     tp.Warmup,
+		DSCP:       tp.DSCP,
+	}
+	if config := tp.config; config != nil {
+		snapshot.AddressFamily = config.AddressFamily
+		snapshot.SrvRefresh = config.SrvRefresh
+		snapshot.SrvStrict = config.SrvStrict
+		snapshot.MinHosts = config.MinHosts
+		snapshot.RemovedHostPolicy = config.RemovedHostPolicy
+		snapshot.HealthInterval = config.HealthInterval
+		snapshot.Allow, snapshot.Deny = config.Allow, config.Deny
+		snapshot.Token = config.Token != ""
+	}
+	priority, active := activePriority(tp.hosts, nil)
+	for i := range tp.hosts {
+		host := &tp.hosts[i]
+		h := hostSnapshot{
+			Name:     host.Name,
+			Addr:     host.Addr,
+			Resolved: host.addr.String(),
+			Srv:      host.srv,
+			Weight:   host.Weight,
+			Priority: host.Priority,
+			Labels:   host.Labels,
+		}
+		if active && host.Priority == priority && host.weighted() {
+			h.EffectiveWeight = host.Weight
+		}
+		if host.proxy != nil {
+			h.Proxy = host.proxy.Addr
+		}
+		h.Interface = host.iface
+		if host.tlsConfig != nil {
+			h.TLSServerName = host.tlsConfig.ServerName
+		}
+		h.Down = host.state.isDown()
+		h.DialFailureRatio, h.DialSamples = host.state.DialFailureRatio()
+		h.Conns, h.MaxConns = host.state.NumOfConns(), host.MaxConns
+		h.Pooled = host.state.pool.size()
+		h.MaxNewConnsPerSec, h.MaxNewConnsPerIPPerSec = host.MaxNewConnsPerSec, host.MaxNewConnsPerIPPerSec
+		h.UploadMinPacket, h.UploadMaxDelay = host.UploadMinPacket, host.UploadMaxDelay
+		snapshot.Hosts = append(snapshot.Hosts, h)
+	}
+	return snapshot
+}
+
+func (tp *LocalConnProvider) NumOfDialRetries() int64 {
+	return atomic.LoadInt64(&tp.dialRetries)
+}
+
+func (tp *LocalConnProvider) NumOfRateLimited() int64 {
+	return atomic.LoadInt64(&tp.rateLimited)
+}
+
+// LimitedIPs returns source ips tracked by rate limiters, and those evicted
+// or refused when full
+func (tp *LocalConnProvider) LimitedIPs() (size int, evicted, refused int64) {
+	tp.Lock()
+	defer tp.Unlock()
+	for _, l := range tp.limiters {
+		size += l.ips.Len()
+		evicted += l.ips.NumOfEvicted()
+		refused += l.ips.NumOfRefused()
+	}
+	return
+}
+
+func (tp *LocalConnProvider) NumOfHostsRejected() int64 {
+	return atomic.LoadInt64(&tp.hostsRejected)
+}
+
+// DialFailureRatios returns dial failure ratio in window by host key
+func (tp *LocalConnProvider) DialFailureRatios() map[string]float64 {
+	tp.Lock()
+	defer tp.Unlock()
+	ratios := make(map[string]float64)
+	for i := range tp.hosts {
+		ratios[tp.hosts[i].key()], _ = tp.hosts[i].state.DialFailureRatio()
+	}
+	return ratios
+}
+
+// Health returns up or down of every host by key
+func (tp *LocalConnProvider) Health() map[string]string {
+	tp.Lock()
+	defer tp.Unlock()
+	health := make(map[string]string)
+	for i := range tp.hosts {
+		if tp.hosts[i].state.isDown() {
+			health[tp.hosts[i].key()] = "down"
+		} else {
+			health[tp.hosts[i].key()] = "up"
+		}
+	}
+	return health
+}
+
+// NewLocalConnProvider returns a provider of hosts in configFile, Reload loads it
+func NewLocalConnProvider(configFile string) *LocalConnProvider {
+	return &LocalConnProvider{
+		ConfigFile: configFile,
+		srvCache:   make(map[string][]*net.SRV),
+		closed:     make(chan struct{}),
+		poolWake:   make(chan struct{}, 1),
+	}
+}
+
+// Close stops background refreshes started by the first Reload
+func (tp *LocalConnProvider) Close() {
+	tp.closeOnce.Do(func() {
+		close(tp.closed)
+	})
+}
+
+// sleep waits d, returns false if tp is closed meanwhile
+func (tp *LocalConnProvider) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-tp.closed:
+		return false
+	}
+}
+
+// Reload loads the config file, background refreshes of srv and health are
+// started on the first success
+func (tp *LocalConnProvider) Reload() error {
+	config, err := readConfig(tp.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if err := tp.reset(config); err != nil {
+		return err
+	}
+	tp.startOnce.Do(func() {
+		go tp.refreshSrv()
+		go tp.checkHealth()
+		if tp.WarmPool > 0 {
+			go tp.fillPools()
+		}
+	})
+	if tp.Warmup {
+		tp.Lock()
+		hosts := tp.hosts
+		health := tp.config.HealthInterval > 0
+		tp.Unlock()
+		go tp.warmup(hosts, health)
+	}
+	return nil
+}
+
+// Check validates the config file as Reload does without running it, an
+// invalid config is reported by a *ConfigError with every problem found,
+// warnings are logged
+func (tp *LocalConnProvider) Check() error {
+	config, err := readConfig(tp.ConfigFile)
+	if err != nil {
+		return err
+	}
+	tp.resetMutex.Lock()
+	defer tp.resetMutex.Unlock()
+	loaded, err := tp.load(config)
+	if err != nil {
+		return err
+	}
+	for _, warning := range loaded.warnings {
+		Log("config warning: %s", warning)
+	}
+	return nil
+}
+
+func readConfig(file string) (*Config, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var config Config
+	dec := json.NewDecoder(fp)
+	if err := dec.Decode(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
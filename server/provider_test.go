@@ -0,0 +1,560 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+func TestGetHostByWeight(t *testing.T) {
+	const selections = 100000
+	const tolerance = 0.01
+
+	cases := []struct {
+		name    string
+		weights []int
+	}{
+		{"skewed", []int{1, 99}},
+		{"even", []int{50, 50}},
+		{"mixed", []int{10, 20, 30, 40}},
+		{"zero weight", []int{0, 30, 70}},
+		{"single", []int{5}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tp := &LocalConnProvider{}
+			total := 0
+			for i, w := range c.weights {
+				tp.hosts = append(tp.hosts, Host{
+					Name:   string(rune('a' + i)),
+					Weight: w,
+					state:  newHostState(0),
+				})
+				total += w
+			}
+
+			counts := make(map[string]int)
+			for i := 0; i < selections; i++ {
+				host := tp.GetHostByWeight()
+				if host == nil {
+					t.Fatal("no host selected")
+				}
+				counts[host.Name]++
+			}
+
+			for _, host := range tp.hosts {
+				expected := float64(host.Weight) / float64(total)
+				share := float64(counts[host.Name]) / selections
+				if math.Abs(share-expected) > tolerance {
+					t.Errorf("host %s weight %d: share %.4f, expected %.4f", host.Name, host.Weight, share, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestGetHostByWeightNoWeight(t *testing.T) {
+	tp := &LocalConnProvider{}
+	if host := tp.GetHostByWeight(); host != nil {
+		t.Errorf("selected %s from no hosts", host.Name)
+	}
+
+	tp.hosts = []Host{{Name: "a", state: newHostState(0)}}
+	if host := tp.GetHostByWeight(); host != nil {
+		t.Errorf("selected %s of weight 0", host.Name)
+	}
+}
+
+func TestGetHostByWeightPriority(t *testing.T) {
+	tp := &LocalConnProvider{}
+	for i, priority := range []int{0, 0, 10, 20} {
+		tp.hosts = append(tp.hosts, Host{
+			Name:     string(rune('a' + i)),
+			Weight:   10,
+			Priority: priority,
+			addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 1248},
+			state:    newHostState(0),
+		})
+	}
+	for i := 0; i < 100; i++ {
+		if host := tp.GetHostByWeight(); host == nil || host.Priority != 0 {
+			t.Fatalf("selected %v, expected priority 0", host)
+		}
+	}
+
+	// priority 10 takes over when all of priority 0 are down
+	tp.hosts[0].state.setDown(true)
+	tp.hosts[1].state.setDown(true)
+	for i := 0; i < 100; i++ {
+		if host := tp.GetHostByWeight(); host == nil || host.Name != "c" {
+			t.Fatalf("selected %v, expected c of priority 10", host)
+		}
+	}
+	if snapshot := tp.Snapshot(); snapshot.Hosts[2].EffectiveWeight != 10 || snapshot.Hosts[0].EffectiveWeight != 0 {
+		t.Errorf("effective weights %d, %d", snapshot.Hosts[0].EffectiveWeight, snapshot.Hosts[2].EffectiveWeight)
+	}
+
+	// and priority 20 when c was tried
+	tried := map[string]bool{tp.hosts[2].addr.String(): true}
+	if host := tp.getHostByWeight(tried); host == nil || host.Name != "d" {
+		t.Errorf("selected %v, expected d of priority 20", host)
+	}
+	tried[tp.hosts[3].addr.String()] = true
+	if host := tp.getHostByWeight(tried); host != nil {
+		t.Errorf("selected %s with all hosts out", host.Name)
+	}
+}
+
+var errRefused = errors.New("connection refused")
+
+// fakeDialer connects hosts except refused ones to a local listener, and
+// records dialed host names
+type fakeDialer struct {
+	ln      *net.TCPListener
+	refused map[string]bool
+	dialed  []string
+}
+
+func (d *fakeDialer) dial(host *Host, timeout time.Duration, params *sockParams) (*net.TCPConn, error) {
+	d.dialed = append(d.dialed, host.Name)
+	if d.refused[host.Name] {
+		return nil, errRefused
+	}
+	return net.DialTCP("tcp", nil, d.ln.Addr().(*net.TCPAddr))
+}
+
+func newRetryProvider(t *testing.T, names []string, refused ...string) (*LocalConnProvider, *fakeDialer) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	d := &fakeDialer{ln: ln, refused: make(map[string]bool)}
+	for _, name := range refused {
+		d.refused[name] = true
+	}
+	tp := &LocalConnProvider{config: &Config{}, dial: d.dial}
+	for i, name := range names {
+		tp.hosts = append(tp.hosts, Host{
+			Name:   name,
+			Weight: 10,
+			addr:   &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 1248},
+			state:  newHostState(0),
+		})
+	}
+	return tp, d
+}
+
+func remoteConnTo(target string) *scp.Conn {
+	return scp.Client(nil, &scp.Config{TargetServer: target})
+}
+
+func TestCreateLocalConnRetry(t *testing.T) {
+	cases := []struct {
+		name     string
+		hosts    []string
+		refused  []string
+		target   string
+		attempts int
+		ok       bool
+		dials    int // -1 means any number up to attempts
+	}{
+		{"all up", []string{"a", "b", "c"}, nil, "", 3, true, 1},
+		{"one refused", []string{"a", "b"}, []string{"a"}, "", 3, true, -1},
+		{"all refused", []string{"a", "b", "c"}, []string{"a", "b", "c"}, "", 3, false, 3},
+		{"attempts bound", []string{"a", "b", "c", "d"}, []string{"a", "b", "c", "d"}, "", 2, false, 2},
+		{"fewer hosts than attempts", []string{"a", "b"}, []string{"a", "b"}, "", 5, false, 2},
+		{"named no retry", []string{"a", "b"}, []string{"a"}, "a", 3, false, 1},
+		{"named shared", []string{"a", "a", "b"}, nil, "a", 3, true, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tp, d := newRetryProvider(t, c.hosts, c.refused...)
+			tp.config.DialAttempts = c.attempts
+			conn, host, err := tp.CreateLocalConn(remoteConnTo(c.target))
+			if c.ok {
+				if err != nil {
+					t.Fatalf("unexpected error: %v, dialed %v", err, d.dialed)
+				}
+				conn.Close()
+				if d.refused[host.Name] {
+					t.Errorf("selected refused host %s", host.Name)
+				}
+				if c.target != "" && host.Name != c.target {
+					t.Errorf("selected %s for target %s", host.Name, c.target)
+				}
+			} else if err != errRefused {
+				t.Fatalf("expected last dial error, got %v", err)
+			}
+			if c.dials >= 0 && len(d.dialed) != c.dials {
+				t.Errorf("dialed %v, expected %d dials", d.dialed, c.dials)
+			}
+			if len(d.dialed) > c.attempts {
+				t.Errorf("dialed %d hosts over %d attempts", len(d.dialed), c.attempts)
+			}
+			if retries := tp.NumOfDialRetries(); retries != int64(len(d.dialed)-1) {
+				t.Errorf("%d retries counted for %d dials", retries, len(d.dialed))
+			}
+		})
+	}
+}
+
+func TestCreateLocalConnRetrySameName(t *testing.T) {
+	tp, d := newRetryProvider(t, []string{"a", "a", "a", "b"})
+	// refuse the first two hosts named a by address
+	refusedAddrs := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		refusedAddrs[tp.hosts[i].addr.String()] = true
+	}
+	tp.dial = func(host *Host, timeout time.Duration, params *sockParams) (*net.TCPConn, error) {
+		if refusedAddrs[host.addr.String()] {
+			d.dialed = append(d.dialed, host.addr.String())
+			return nil, errRefused
+		}
+		return d.dial(host, timeout, params)
+	}
+
+	conn, host, err := tp.CreateLocalConn(remoteConnTo("a"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+	if host.Name != "a" || refusedAddrs[host.addr.String()] {
+		t.Errorf("selected %s(%s)", host.Name, host.addr)
+	}
+	if len(d.dialed) != 3 {
+		t.Errorf("dialed %v, expected 3 dials", d.dialed)
+	}
+}
+
+func TestCreateLocalConnNoHost(t *testing.T) {
+	tp, d := newRetryProvider(t, []string{"b", "a", "b"})
+	_, _, err := tp.CreateLocalConn(remoteConnTo("missing"))
+	if !errors.Is(err, errNoHost) {
+		t.Errorf("expected errNoHost, got %v", err)
+	}
+	if err == nil || err.Error() != "no host named missing, known names: a, b" {
+		t.Errorf("error %v", err)
+	}
+	if len(d.dialed) != 0 {
+		t.Errorf("dialed %v", d.dialed)
+	}
+}
+
+func TestCreateLocalConnNotLoaded(t *testing.T) {
+	tp := NewLocalConnProvider(filepath.Join(t.TempDir(), "settings.conf"))
+	for _, target := range []string{"", "echo"} {
+		if _, _, err := tp.CreateLocalConn(remoteConnTo(target)); err != errNoHost {
+			t.Errorf("target %q: expected errNoHost, got %v", target, err)
+		}
+	}
+	if host := tp.GetHost(""); host != nil {
+		t.Errorf("selected %v before loading", host)
+	}
+}
+
+func TestSharedNames(t *testing.T) {
+	tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV)}
+	config := &Config{Hosts: []Host{
+		{Addr: "127.0.0.1:1248", Name: "gate1", Weight: 10},
+		{Addr: "127.0.0.1:1249", Name: "gate2", Weight: 10},
+		{Addr: "127.0.0.1:1250", Name: "gate1", Weight: 10},
+		{Addr: "127.0.0.1:1251", Weight: 10},
+		{Addr: "127.0.0.1:1252", Weight: 10},
+	}}
+	loaded, err := tp.load(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "host name gate1 is shared by 2 hosts (127.0.0.1:1248, 127.0.0.1:1250), selected by name as a group"
+	if len(loaded.warnings) != 1 || loaded.warnings[0] != expected {
+		t.Errorf("warnings %q", loaded.warnings)
+	}
+
+	// hosts of a srv share its name
+	hosts := []Host{
+		{Name: "game", srv: "_game._tcp.test", addr: &net.TCPAddr{Port: 1}},
+		{Name: "game", srv: "_game._tcp.test", addr: &net.TCPAddr{Port: 2}},
+	}
+	if warnings := sharedNames(hosts); len(warnings) != 0 {
+		t.Errorf("srv warnings %q", warnings)
+	}
+}
+
+func TestResetDialOptions(t *testing.T) {
+	hosts := func(h Host) []Host {
+		h.Addr, h.Name, h.Weight = "127.0.0.1:1248", "test", 10
+		return []Host{h}
+	}
+	invalid := []*Config{
+		{Hosts: hosts(Host{}), DialTimeoutMs: -1},
+		{Hosts: hosts(Host{DialTimeoutMs: -1})},
+		{Hosts: hosts(Host{}), KeepaliveSec: -1},
+		{Hosts: hosts(Host{KeepaliveSec: -1}), KeepaliveSec: 10},
+	}
+	for i, config := range invalid {
+		tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV)}
+		if err := tp.reset(config); err == nil {
+			t.Errorf("case %d: negative value accepted", i)
+		}
+	}
+
+	tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV)}
+	config := &Config{Hosts: hosts(Host{DialTimeoutMs: 200}), DialTimeoutMs: 1000, KeepaliveSec: 10}
+	if err := tp.reset(config); err != nil {
+		t.Fatal(err)
+	}
+	host := tp.hosts[0]
+	if host.dialTimeout != 200*time.Millisecond || host.keepalive != 10*time.Second {
+		t.Errorf("dial timeout %v, keepalive %v", host.dialTimeout, host.keepalive)
+	}
+}
+
+func TestDialProxyTimeout(t *testing.T) {
+	// a proxy that accepts but never answers CONNECT
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	cases := []struct {
+		dial    time.Duration
+		proxy   int // proxy timeout_ms
+		timeout time.Duration
+	}{
+		{100 * time.Millisecond, 0, 100 * time.Millisecond},
+		{0, 100, 100 * time.Millisecond},
+		{100 * time.Millisecond, 5000, 100 * time.Millisecond},
+		{5 * time.Second, 100, 100 * time.Millisecond},
+	}
+	for i, c := range cases {
+		proxy := &ProxyConfig{Addr: ln.Addr().String(), Timeout: c.proxy}
+		if timeout := handshakeTimeout(c.dial, proxy); timeout != c.timeout {
+			t.Errorf("case %d: handshake timeout %v, expected %v", i, timeout, c.timeout)
+		}
+		host := &Host{Addr: "127.0.0.1:1248", proxy: proxy}
+		tp := &LocalConnProvider{}
+		start := time.Now()
+		conn, err := tp.dialHost(host, c.dial, nil)
+		if err == nil {
+			conn.Close()
+			t.Errorf("case %d: dialed through a silent proxy", i)
+			continue
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("case %d: %v, expected timeout", i, err)
+		}
+		if elapsed := time.Since(start); elapsed > c.timeout+time.Second {
+			t.Errorf("case %d: handshake took %v", i, elapsed)
+		}
+	}
+}
+
+func TestResetLimiters(t *testing.T) {
+	config := func(rate int, names ...string) *Config {
+		c := &Config{}
+		for i, name := range names {
+			c.Hosts = append(c.Hosts, Host{
+				Addr:              fmt.Sprintf("127.0.0.1:%d", 1248+i),
+				Name:              name,
+				Weight:            10,
+				MaxNewConnsPerSec: rate,
+			})
+		}
+		return c
+	}
+	tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV)}
+	if err := tp.reset(config(5, "a", "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	a, b := tp.limiters["a"], tp.limiters["b"]
+	if a == nil || b == nil || a == b || tp.hosts[0].limiter != a || tp.hosts[1].limiter != a {
+		t.Fatalf("limiters %v, hosts share by name", tp.limiters)
+	}
+
+	// reload keeps the bucket of an unchanged name
+	if err := tp.reset(config(5, "a", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if tp.limiters["a"] != a || tp.limiters["b"] != nil {
+		t.Errorf("limiters %v after reload", tp.limiters)
+	}
+	if err := tp.reset(config(6, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if l := tp.limiters["a"]; l == a || l.rate != 6 {
+		t.Errorf("limiter of a not replaced on rate change")
+	}
+
+	conflicting := config(5, "a", "a")
+	conflicting.Hosts[1].MaxNewConnsPerSec = 8
+	if err := tp.reset(conflicting); err == nil {
+		t.Error("conflicting rates of a name accepted")
+	}
+	if err := tp.reset(config(-1, "a")); err == nil {
+		t.Error("negative rate accepted")
+	}
+	if err := tp.reset(config(0, "a")); err != nil || tp.hosts[0].limiter != nil {
+		t.Errorf("unlimited host has limiter, %v", err)
+	}
+}
+
+func TestResetReportsAllProblems(t *testing.T) {
+	tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV)}
+	good := &Config{Hosts: []Host{{Addr: "127.0.0.1:1248", Name: "a", Weight: 10}}}
+	if err := tp.reset(good); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := &Config{
+		Hosts: []Host{
+			{Addr: "127.0.0.1:1248", Name: "a", Weight: 10},
+			{Addr: "127.0.0.1:1249", Name: "b", Weight: -1},
+			{Addr: "no port", Name: "c", Weight: 10},
+			{Addr: "127.0.0.1:1248", Name: "a", Weight: 5},
+			{Addr: "127.0.0.1:1250", Name: "a", Weight: 5}, // same name, another addr
+		},
+		RemovedHostPolicy: "drop",
+	}
+	err := tp.reset(bad)
+	e, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected *ConfigError, got %v", err)
+	}
+	expected := []string{"host b: invalid weight", "host c:", "host a: duplicate addr", "removed_host_policy"}
+	if len(e.Problems) != len(expected) {
+		t.Fatalf("problems %q, expected %d", e.Problems, len(expected))
+	}
+	for i, prefix := range expected {
+		if !strings.Contains(e.Problems[i], prefix) {
+			t.Errorf("problem %d: %q, expected %q", i, e.Problems[i], prefix)
+		}
+	}
+
+	// the running config is untouched
+	if tp.config != good || len(tp.hosts) != 1 {
+		t.Errorf("running config replaced by invalid config")
+	}
+}
+
+func TestNamedOnlyHosts(t *testing.T) {
+	tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV)}
+	config := &Config{Hosts: []Host{
+		{Addr: "127.0.0.1:1248", Name: "a", Weight: 10},
+		{Addr: "127.0.0.1:1249", Name: "standby", Weight: 0},
+		{Addr: "127.0.0.1:1250", Name: "old", Weight: 10, Drain: true},
+	}}
+	if err := tp.reset(config); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if host := tp.GetHostByWeight(); host == nil || host.Name != "a" {
+			t.Fatalf("selected %v by weight", host)
+		}
+	}
+	if host := tp.GetHostByName("standby"); host == nil || host.Name != "standby" {
+		t.Errorf("selected %v by name standby", host)
+	}
+	if host := tp.GetHostByName("old"); host == nil || host.Name != "a" {
+		t.Errorf("selected %v by name old, expected fallback to a", host)
+	}
+
+	// hosts of weight 0 or draining don't keep a config running
+	err := tp.reset(&Config{Hosts: []Host{
+		{Addr: "127.0.0.1:1249", Name: "standby", Weight: 0},
+		{Addr: "127.0.0.1:1250", Name: "old", Weight: 10, Drain: true},
+	}})
+	if err == nil || err.Error() != "no hosts" {
+		t.Errorf("expected no hosts, got %v", err)
+	}
+}
+
+func TestGetHostDuringReset(t *testing.T) {
+	tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV)}
+	configs := []*Config{
+		{Hosts: []Host{{Addr: "127.0.0.1:1248", Name: "a", Weight: 10}}},
+		{Hosts: []Host{{Addr: "127.0.0.1:1249", Name: "b", Weight: 10, Priority: 1}}},
+	}
+	if err := tp.reset(configs[0]); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := tp.reset(configs[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if host := tp.GetHostByWeight(); host == nil {
+			t.Fatal("no host selected by weight")
+		}
+		tp.GetHostByName("a")
+		tp.missingName("b")
+	}
+	<-done
+}
+
+func TestWarmup(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	for _, health := range []bool{false, true} {
+		tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV)}
+		config := &Config{Hosts: []Host{
+			{Addr: ln.Addr().String(), Name: "up", Weight: 10},
+			{Addr: closed.Addr().String(), Name: "down", Weight: 10},
+		}}
+		if err := tp.reset(config); err != nil {
+			t.Fatal(err)
+		}
+		tp.warmup(tp.hosts, health)
+		if tp.hosts[0].state.isDown() || tp.hosts[1].state.isDown() != health {
+			t.Errorf("health %v: up %v, down %v", health, !tp.hosts[0].state.isDown(), tp.hosts[1].state.isDown())
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ProxyConfig is an http forward proxy for backend connections
+type ProxyConfig struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Timeout  int    `json:"timeout_ms"` // CONNECT handshake timeout, 0 means no timeout
+}
+
+const maxProxyResponse = 4096
+
+// readProxyResponse reads response head byte by byte, so tunneled data
+// following it is left in the conn
+func readProxyResponse(conn net.Conn) (string, error) {
+	var head []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= maxProxyResponse {
+			return "", fmt.Errorf("proxy response too large")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		head = append(head, b[0])
+	}
+	return string(head[:bytes.Index(head, []byte("\r\n"))]), nil
+}
+
+// handshakeTimeout is the smaller non zero one of dial and proxy timeouts,
+// 0 means no timeout
+func handshakeTimeout(dial time.Duration, proxy *ProxyConfig) time.Duration {
+	timeout := time.Duration(proxy.Timeout) * time.Millisecond
+	if dial > 0 && (timeout <= 0 || dial < timeout) {
+		timeout = dial
+	}
+	return timeout
+}
+
+// dialHTTPProxy connects to addr through an http CONNECT tunnel, the CONNECT
+// handshake is bounded by the dial timeout as well as the proxy timeout
+func dialHTTPProxy(dialer *net.Dialer, proxy *ProxyConfig, addr string) (*net.TCPConn, error) {
+	c, err := dialer.Dial("tcp", proxy.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.TCPConn)
+
+	if timeout := handshakeTimeout(dialer.Timeout, proxy); timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxy.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	status, err := readProxyResponse(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// HTTP/1.1 200 Connection established
+	fields := strings.SplitN(status, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") || fields[1] != "200" {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s CONNECT %s failed: %s", proxy.Addr, addr, status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// PROXY protocol versions of backend connections
+const (
+	ProxyProtocolOff = "off"
+	ProxyProtocolV1  = "v1" // text header
+	ProxyProtocolV2  = "v2" // binary header
+)
+
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyAddr returns ip and port of a tcp or udp address, nil ip if unknown
+func proxyAddr(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, true
+	case *net.UDPAddr:
+		return a.IP, a.Port, false
+	}
+	return nil, 0, true
+}
+
+// writeProxyHeader writes a PROXY protocol header of version telling the
+// backend that the session is from src to dst
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcIP, srcPort, stream := proxyAddr(src)
+	dstIP, dstPort, _ := proxyAddr(dst)
+	ipv4 := srcIP.To4() != nil && dstIP.To4() != nil
+	if ipv4 {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+	known := srcIP != nil && dstIP != nil
+
+	var buf bytes.Buffer
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			buf.WriteString("PROXY UNKNOWN\r\n")
+			break
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		fmt.Fprintf(&buf, "PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcPort, dstPort)
+	case ProxyProtocolV2:
+		buf.Write(proxyProtocolV2Sig)
+		buf.WriteByte(0x21) // version 2, PROXY command
+		if !known {
+			buf.Write([]byte{0x00, 0, 0}) // AF_UNSPEC, no addresses
+			break
+		}
+		var family byte = 0x20 // AF_INET6
+		if ipv4 {
+			family = 0x10 // AF_INET
+		}
+		if stream {
+			family |= 0x01
+		} else {
+			family |= 0x02
+		}
+		buf.WriteByte(family)
+		binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		binary.Write(&buf, binary.BigEndian, uint16(srcPort))
+		binary.Write(&buf, binary.BigEndian, uint16(dstPort))
+	default:
+		return fmt.Errorf("invalid proxy protocol: %s", version)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWriteProxyHeader(t *testing.T) {
+	tcpAddr := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	udpAddr := func(ip string, port int) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: port} }
+	sig := string(proxyProtocolV2Sig)
+
+	cases := []struct {
+		version  string
+		src, dst net.Addr
+		header   string
+	}{
+		{ProxyProtocolV1, tcpAddr("10.0.0.1", 5000), tcpAddr("10.0.0.2", 1248), "PROXY TCP4 10.0.0.1 10.0.0.2 5000 1248\r\n"},
+		{ProxyProtocolV1, tcpAddr("2001:db8::1", 5000), tcpAddr("2001:db8::2", 1248), "PROXY TCP6 2001:db8::1 2001:db8::2 5000 1248\r\n"},
+		// ipv4 client on a dual stack listener
+		{ProxyProtocolV1, tcpAddr("10.0.0.1", 5000), tcpAddr("::ffff:10.0.0.2", 1248), "PROXY TCP4 10.0.0.1 10.0.0.2 5000 1248\r\n"},
+		{ProxyProtocolV1, &net.UnixAddr{Name: "x"}, tcpAddr("10.0.0.2", 1248), "PROXY UNKNOWN\r\n"},
+		{ProxyProtocolV2, tcpAddr("10.0.0.1", 5000), tcpAddr("10.0.0.2", 1248),
+			sig + "\x21\x11\x00\x0c\x0a\x00\x00\x01\x0a\x00\x00\x02\x13\x88\x04\xe0"},
+		{ProxyProtocolV2, udpAddr("2001:db8::1", 5000), udpAddr("2001:db8::2", 1248),
+			sig + "\x21\x22\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x13\x88\x04\xe0"},
+		{ProxyProtocolV2, &net.UnixAddr{Name: "x"}, tcpAddr("10.0.0.2", 1248), sig + "\x21\x00\x00\x00"},
+	}
+	for i, c := range cases {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, c.version, c.src, c.dst); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if buf.String() != c.header {
+			t.Errorf("case %d: header %q, expected %q", i, buf.String(), c.header)
+		}
+	}
+
+	if err := writeProxyHeader(&bytes.Buffer{}, "v3", tcpAddr("10.0.0.1", 1), tcpAddr("10.0.0.2", 2)); err == nil {
+		t.Error("invalid version accepted")
+	}
+}
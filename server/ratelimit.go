@@ -0,0 +1,174 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// leakyBucket admits events at a fixed rate, bursts are delayed up to
+// maxDelay and dropped beyond it, so waiters can't pile up
+type leakyBucket struct {
+	waiting  int64 // events being delayed, atomic
+	delayed  int64 // total delay in nanoseconds, atomic
+	rejected int64 // events that would wait longer than maxDelay, atomic
+
+	sync.Mutex
+	interval time.Duration
+	maxDelay time.Duration
+	next     time.Time // next free slot
+}
+
+// Wait blocks until the event's slot, returns how long it was delayed, or
+// false at once without taking a slot if it would wait longer than maxDelay
+func (b *leakyBucket) Wait() (time.Duration, bool) {
+	b.Lock()
+	now := time.Now()
+	slot := b.next
+	if slot.Before(now) {
+		slot = now
+	}
+	if slot.Sub(now) > b.maxDelay {
+		b.Unlock()
+		atomic.AddInt64(&b.rejected, 1)
+		return 0, false
+	}
+	b.next = slot.Add(b.interval)
+	b.Unlock()
+
+	delay := slot.Sub(now)
+	if delay > 0 {
+		atomic.AddInt64(&b.waiting, 1)
+		time.Sleep(delay)
+		atomic.AddInt64(&b.waiting, -1)
+		atomic.AddInt64(&b.delayed, int64(delay))
+	}
+	return delay, true
+}
+
+func (b *leakyBucket) Waiting() int64 {
+	return atomic.LoadInt64(&b.waiting)
+}
+
+func (b *leakyBucket) Delayed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.delayed))
+}
+
+func (b *leakyBucket) NumOfRejected() int64 {
+	return atomic.LoadInt64(&b.rejected)
+}
+
+func newLeakyBucket(rate int, maxDelay time.Duration) *leakyBucket {
+	return &leakyBucket{
+		interval: time.Second / time.Duration(rate),
+		maxDelay: maxDelay,
+	}
+}
+
+// tokenBucket holds up to rate tokens refilled at rate per second, counted
+// in nanoseconds of a token so refills are exact. It is not safe for
+// concurrent use.
+type tokenBucket struct {
+	rate   int64
+	credit int64 // token is time.Second of credit
+	last   time.Time
+}
+
+// refill adds tokens earned since the last refill, a new bucket is full
+func (b *tokenBucket) refill(now time.Time) {
+	full := b.rate * int64(time.Second)
+	if b.last.IsZero() {
+		b.credit = full
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		if elapsed > time.Second {
+			elapsed = time.Second
+		}
+		b.credit += int64(elapsed) * b.rate
+		if b.credit > full {
+			b.credit = full
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) empty() bool {
+	return b.credit < int64(time.Second)
+}
+
+func (b *tokenBucket) take() {
+	b.credit -= int64(time.Second)
+}
+
+// full reports whether refilled b is as good as a new bucket
+func (b *tokenBucket) full() bool {
+	return b.credit >= b.rate*int64(time.Second)
+}
+
+// targetLimiter limits new sessions to a target host name, in total and by
+// source ip, kept across reloads while its rates are unchanged
+type targetLimiter struct {
+	sync.Mutex
+	rate   int // per second in total, 0 means no limit
+	ipRate int // per second of each source ip, 0 means no limit
+	total  tokenBucket
+	ips    *ipTable // of *tokenBucket, bounded by -ipTableSize
+}
+
+// prune deletes buckets that refilled to full at now, they carry no state
+func (l *targetLimiter) prune(now time.Time) {
+	l.ips.Range(func(ip string, v interface{}) {
+		b := v.(*tokenBucket)
+		b.refill(now)
+		if b.full() {
+			l.ips.Delete(ip)
+		}
+	})
+}
+
+// allow reports whether a new session from ip is admitted at now
+func (l *targetLimiter) allow(ip string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	// a session denied by one bucket is not charged on the other
+	var ipBucket *tokenBucket
+	if l.ipRate > 0 {
+		v, ok := l.ips.Get(ip)
+		if !ok {
+			v = &tokenBucket{rate: int64(l.ipRate)}
+			if l.ips.Put(ip, v) != nil {
+				// full of the closed policy, a source that can't be
+				// tracked is denied rather than left unlimited
+				l.prune(now)
+				if l.ips.Put(ip, v) != nil {
+					return false
+				}
+			}
+		}
+		ipBucket = v.(*tokenBucket)
+		ipBucket.refill(now)
+	}
+	if l.rate > 0 {
+		l.total.refill(now)
+	}
+	if (ipBucket != nil && ipBucket.empty()) || (l.rate > 0 && l.total.empty()) {
+		return false
+	}
+	if ipBucket != nil {
+		ipBucket.take()
+	}
+	if l.rate > 0 {
+		l.total.take()
+	}
+	return true
+}
+
+// newTargetLimiter returns a limiter tracking up to ipTableSize source ips,
+// policy tells what to do when full as of ipTable
+func newTargetLimiter(rate, ipRate, ipTableSize int, policy string) *targetLimiter {
+	return &targetLimiter{
+		rate:   rate,
+		ipRate: ipRate,
+		total:  tokenBucket{rate: int64(rate)},
+		ips:    newIPTable(ipTableSize, policy),
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTargetLimiter(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	// 20 sessions per second against a limit of 10, the burst of 10 refills
+	// by half a token a session, then every other session is admitted
+	l := newTargetLimiter(10, 0, 0, IPTableOpen)
+	pattern := ""
+	for i := 0; i < 30; i++ {
+		if l.allow("10.0.0.1", start.Add(time.Duration(i)*50*time.Millisecond)) {
+			pattern += "+"
+		} else {
+			pattern += "-"
+		}
+	}
+	if expected := "+++++++++++++++++++-+-+-+-+-+-"; pattern != expected {
+		t.Errorf("pattern %s, expected %s", pattern, expected)
+	}
+
+	// an idle limiter refills up to its burst only
+	now := start.Add(time.Hour)
+	admitted := 0
+	for i := 0; i < 20; i++ {
+		if l.allow("10.0.0.1", now) {
+			admitted++
+		}
+	}
+	if admitted != 10 {
+		t.Errorf("admitted %d after idle, expected 10", admitted)
+	}
+
+	// sources are limited separately, and a source denied by its own limit
+	// is not charged on the total
+	l = newTargetLimiter(3, 2, 0, IPTableOpen)
+	cases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.1", true},
+		{"10.0.0.1", false},
+		{"10.0.0.1", false},
+		{"10.0.0.2", true},
+		{"10.0.0.3", false}, // total exhausted
+	}
+	for i, c := range cases {
+		if allowed := l.allow(c.ip, start); allowed != c.allowed {
+			t.Errorf("case %d: %s allowed %v", i, c.ip, allowed)
+		}
+	}
+}
+
+func TestTargetLimiterIPTable(t *testing.T) {
+	start := time.Unix(1000, 0)
+	cases := []struct {
+		policy  string
+		at      time.Duration // since start
+		ip      string
+		allowed bool
+		size    int
+	}{
+		{IPTableClosed, 0, "10.0.0.1", true, 1},
+		{IPTableClosed, 0, "10.0.0.2", true, 2},
+		{IPTableClosed, 0, "10.0.0.3", false, 2}, // full, nothing to prune
+		{IPTableClosed, 0, "10.0.0.1", true, 2},
+		{IPTableClosed, 2 * time.Second, "10.0.0.3", true, 1}, // pruned refilled buckets
+		{IPTableOpen, 0, "10.0.0.1", true, 1},
+		{IPTableOpen, 0, "10.0.0.2", true, 2},
+		{IPTableOpen, 0, "10.0.0.3", true, 2}, // 10.0.0.1 evicted
+	}
+	var l *targetLimiter
+	for i, c := range cases {
+		if i == 0 || c.policy != cases[i-1].policy {
+			l = newTargetLimiter(0, 2, 2, c.policy)
+		}
+		if allowed := l.allow(c.ip, start.Add(c.at)); allowed != c.allowed {
+			t.Errorf("case %d: %s allowed %v", i, c.ip, allowed)
+		}
+		if l.ips.Len() != c.size {
+			t.Errorf("case %d: size %d, expected %d", i, l.ips.Len(), c.size)
+		}
+	}
+	if l.ips.NumOfEvicted() != 1 || l.ips.NumOfRefused() != 0 {
+		t.Errorf("open: evicted %d, refused %d", l.ips.NumOfEvicted(), l.ips.NumOfRefused())
+	}
+}
+
+func TestLeakyBucketMaxDelay(t *testing.T) {
+	// slots are 100ms apart, a burst of 6 fits 3 slots within 250ms
+	b := newLeakyBucket(10, 250*time.Millisecond)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	admitted := 0
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			delay, ok := b.Wait()
+			if !ok && time.Since(start) > 50*time.Millisecond {
+				t.Errorf("rejected after %v", time.Since(start))
+			}
+			if ok && delay > 250*time.Millisecond {
+				t.Errorf("delayed %v", delay)
+			}
+			if ok {
+				mutex.Lock()
+				admitted++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if admitted != 3 || b.NumOfRejected() != 3 || b.Waiting() != 0 {
+		t.Errorf("admitted %d, rejected %d, waiting %d", admitted, b.NumOfRejected(), b.Waiting())
+	}
+
+	// rejected events took no slot
+	time.Sleep(100 * time.Millisecond)
+	if delay, ok := b.Wait(); !ok || delay != 0 {
+		t.Errorf("delayed %v after the burst, ok %v", delay, ok)
+	}
+}
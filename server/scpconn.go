@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"errors"
@@ -47,12 +47,14 @@ func (s *SCPConn) setErrorWithLocked(err error) {
 				panic(s.reuseCh != nil)
 			}
 
-			s.reuseCh = make(chan struct{})
+			// the goroutine keeps its own copy, reuse clears the field
+			reuseCh := make(chan struct{})
+			s.reuseCh = reuseCh
 			go func() {
 				select {
 				case <-time.After(s.reuseTimeout):
 					s.Close()
-				case <-s.reuseCh:
+				case <-reuseCh:
 				}
 			}()
 			s.connErr = err
@@ -60,6 +62,13 @@ func (s *SCPConn) setErrorWithLocked(err error) {
 	}
 }
 
+// waitingReuse reports whether the client is gone and reuse is awaited
+func (s *SCPConn) waitingReuse() bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.connErr != nil && !s.connClosed
+}
+
 func (s *SCPConn) setError(err error) {
 	s.connMutex.Lock()
 	defer s.connMutex.Unlock()
@@ -105,6 +114,11 @@ func (s *SCPConn) Write(p []byte) (int, error) {
 	defer s.wr.Unlock()
 
 	n, err := s.Conn.Write(p)
+	if isTimeout(err) {
+		// client is stuck, reuse won't help
+		s.Close()
+		return n, errWriteTimeout
+	}
 	if err != nil {
 		s.closeWrite()
 		s.setError(err)
@@ -113,12 +127,12 @@ func (s *SCPConn) Write(p []byte) (int, error) {
 }
 
 func (s *SCPConn) setClosed() {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
 	if !s.connClosed {
-		s.connMutex.Lock()
 		s.connClosed = true
 		s.connErr = errConnClosed
 		s.connCond.Broadcast()
-		s.connMutex.Unlock()
 	}
 }
 
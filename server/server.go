@@ -0,0 +1,1043 @@
+// Package server implements the scp proxy, it accepts scp sessions and relays
+// them to backend hosts of a LocalConnProvider
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"io"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+var ReuseTimeout = 300 * time.Second
+
+type HalfCloseConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+type ConnPair struct {
+	LocalConn  HalfCloseConn // scp server <-> local server
+	RemoteConn *SCPConn      // client <-> scp server
+
+	host    *Host  // selected backend host
+	network string // transport of the session
+
+	download relay // client -> backend
+	upload   relay // backend -> client
+	reuses   int   // reconnections in lifetime
+
+	tag string      // log prefix of the session, with labels of host if not logged as fields
+	log *connLogger // context of the session in structured logs
+
+	// owned by the idle reaper
+	idleBytes int64     // bytes relayed at the last change
+	idleSince time.Time // when bytes last changed
+}
+
+const (
+	relayIdle = iota
+	relayRead
+	relayWrite
+	relayStates
+)
+
+var relayStateNames = [relayStates]string{"idle", "read", "write"}
+
+// relay holds options and state of one relay direction
+type relay struct {
+	writeTimeout time.Duration // 0 means no timeout
+	maxFrame     int           // max bytes relayed in one write, 0 means unlimited
+	splitFrame   bool          // split oversized frames instead of closing session
+	minPacket    int           // bytes gathered before a write, upload only, 0 means disabled
+	maxDelay     time.Duration // max wait for minPacket
+	sampling     bool          // track state for sampler
+	state        int32         // atomic
+	bytes        *int64        // bytes relayed of the host, nil if metrics disabled, atomic
+	relayed      int64         // bytes relayed of the session, atomic
+}
+
+func (r *relay) setState(state int32) {
+	if r.sampling {
+		atomic.StoreInt32(&r.state, state)
+	}
+}
+
+// relayResult is the statistics of one relay direction
+type relayResult struct {
+	written int
+	packets int
+	err     error
+}
+
+var errWriteTimeout = errors.New("write timeout")
+
+func isTimeout(err error) bool {
+	netError, ok := err.(net.Error)
+	return ok && netError.Timeout()
+}
+
+// writeWithTimeout fails with errWriteTimeout if dst can't accept p in time,
+// which means the peer stopped draining its receive buffer
+func writeWithTimeout(dst HalfCloseConn, p []byte, timeout time.Duration) (int, error) {
+	if timeout <= 0 {
+		return dst.Write(p)
+	}
+	dst.SetWriteDeadline(time.Now().Add(timeout))
+	n, err := dst.Write(p)
+	if isTimeout(err) {
+		err = errWriteTimeout
+	}
+	return n, err
+}
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// write relays p to dst and counts the bytes written
+func (r *relay) write(dst HalfCloseConn, p []byte) (int, error) {
+	n, err := r.writeFrames(dst, p)
+	if n > 0 {
+		atomic.AddInt64(&r.relayed, int64(n))
+		if r.bytes != nil {
+			atomic.AddInt64(r.bytes, int64(n))
+		}
+	}
+	return n, err
+}
+
+// writeFrames writes p to dst, a frame is p of one relay write, which is what a
+// read from the peer returned, frames larger than maxFrame are split or rejected
+func (r *relay) writeFrames(dst HalfCloseConn, p []byte) (int, error) {
+	if r.maxFrame <= 0 || len(p) <= r.maxFrame {
+		return writeWithTimeout(dst, p, r.writeTimeout)
+	}
+	if !r.splitFrame {
+		return 0, errFrameTooLarge
+	}
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > r.maxFrame {
+			n = r.maxFrame
+		}
+		nw, err := writeWithTimeout(dst, p[:n], r.writeTimeout)
+		written += nw
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func downloadUntilClose(dst HalfCloseConn, src HalfCloseConn, ch chan<- relayResult, r *relay) error {
+	var err error
+	var written, packets int
+	buf := make([]byte, scp.NetBufferSize)
+	for {
+		r.setState(relayRead)
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			r.setState(relayWrite)
+			nw, ew := r.write(dst, buf[0:nr])
+			if nw > 0 {
+				packets++
+				written += nw
+			}
+			if ew != nil {
+				err = ew
+				break
+			}
+		}
+		if er != nil {
+			err = er
+			break
+		}
+	}
+	r.setState(relayIdle)
+	src.CloseRead()
+	dst.CloseWrite()
+	ch <- relayResult{written, packets, err}
+	return err
+}
+
+func uploadUntilClose(dst HalfCloseConn, src HalfCloseConn, ch chan<- relayResult, r *relay) error {
+	var err error
+	var written, packets int
+	buf := make([]byte, scp.NetBufferSize)
+
+	for {
+		var nr int
+		var er error
+		r.setState(relayRead)
+		if r.minPacket > 0 && r.maxDelay > 0 {
+			src.SetReadDeadline(time.Now().Add(r.maxDelay))
+			nr, er = io.ReadAtLeast(src, buf, r.minPacket)
+		} else {
+			nr, er = src.Read(buf)
+		}
+
+		if nr > 0 {
+			r.setState(relayWrite)
+			nw, ew := r.write(dst, buf[0:nr])
+			if nw > 0 {
+				packets++
+				written += nw
+			}
+			if ew != nil {
+				err = ew
+				break
+			}
+		}
+		if er != nil {
+			if isTimeout(er) {
+				continue
+			}
+			err = er
+			break
+		}
+	}
+	r.setState(relayIdle)
+	src.CloseRead()
+	dst.CloseWrite()
+	ch <- relayResult{written, packets, err}
+	return err
+}
+
+// closeReason describes why a relay direction from src to dst stopped
+func closeReason(src, dst string, err error) string {
+	if err == errWriteTimeout {
+		return dst + " write timeout"
+	}
+	if err == errFrameTooLarge {
+		return src + " frame too large"
+	}
+	if err == nil || err == io.EOF || err == errConnClosed {
+		return src + " closed"
+	}
+	return src + " error: " + err.Error()
+}
+
+func (p *ConnPair) Reuse(scon *scp.Conn) {
+	p.log.with(LogField{"remote", scon.RemoteAddr().String()}).Info("%s reuse, change remote from [%s><%s] to [%s><%s]", p.tag, p.RemoteConn.RemoteAddr(), p.RemoteConn.LocalAddr(), scon.LocalAddr(), scon.RemoteAddr())
+	p.RemoteConn.SetConn(scon)
+	p.reuses++
+}
+
+// Pump relays data until both directions stop, returns the close reason
+func (p *ConnPair) Pump() string {
+	p.log.Info("%s new pair [%s><%s] [%s><%s]", p.tag, p.RemoteConn.RemoteAddr(), p.RemoteConn.LocalAddr(), p.LocalConn.LocalAddr(), p.LocalConn.RemoteAddr())
+	downloadCh := make(chan relayResult, 1)
+	uploadCh := make(chan relayResult, 1)
+
+	go downloadUntilClose(p.LocalConn, p.RemoteConn, downloadCh, &p.download)
+	go uploadUntilClose(p.RemoteConn, p.LocalConn, uploadCh, &p.upload)
+
+	var dl, ul relayResult
+	var reason string
+	select {
+	case dl = <-downloadCh:
+		reason = closeReason("client", "backend", dl.err)
+		ul = <-uploadCh
+	case ul = <-uploadCh:
+		reason = closeReason("backend", "client", ul.err)
+		dl = <-downloadCh
+	}
+
+	dlSize := 0
+	if dl.written > 0 {
+		dlSize = dl.written / dl.packets
+	}
+	ulSize := 0
+	if ul.written > 0 {
+		ulSize = ul.written / ul.packets
+	}
+	p.log.Info("%s remove pair [%s><%s] [%s><%s], download:(%d:%d:%d), upload:(%d:%d:%d), reason: %s", p.tag,
+		p.RemoteConn.RemoteAddr(), p.RemoteConn.LocalAddr(), p.LocalConn.LocalAddr(), p.LocalConn.RemoteAddr(),
+		dl.written, dl.packets, dlSize, ul.written, ul.packets, ulSize, reason)
+	return reason
+}
+
+type SCPServer struct {
+	goroutineRejected int64 // connections refused by goroutine limit, atomic
+	clientRejected    int64 // connections refused by client list, atomic
+	familyMismatches  int64 // sessions with different client and backend address family, atomic
+	flappingSessions  int64 // sessions reconnected more than reconnectWarn times, atomic
+	crossIPRejected   int64 // reconnections refused by reconnectIP policy, atomic
+	handshakeRetries  int64 // handshake reads retried after temporary errors, atomic
+	conns             int64 // new sessions counted against maxConns, atomic
+	connsRejected     int64 // new sessions refused by maxConns, atomic
+	idleReaped        int64 // sessions closed by idleTimeout, atomic
+	aclDenied         int64 // connections refused by allow/deny of config, atomic
+	tokenRejected     int64 // new sessions refused by token of config, atomic
+
+	// relay state samples by direction, atomic
+	downloadSamples [relayStates]int64
+	uploadSamples   [relayStates]int64
+
+	options      *Options
+	provider     *LocalConnProvider
+	reuseTimeout time.Duration
+	idAllocator  *scp.IDAllocator
+
+	connPairMutex sync.Mutex
+	connPairs     map[int]*ConnPair
+	pairsByHost   map[string]int // sessions by pairHost of their host
+	reuses        int64          // reconnections served
+	dialFailures  int64          // sessions closed as no backend was connected
+
+	clients *clientList
+	events  *eventHub
+	metrics *metrics // nil if disabled
+
+	acceptBucket *leakyBucket // smooth admission of new sessions, nil if unlimited
+
+	goroutineWarn logThrottle
+	maxConnsWarn  logThrottle
+	aclWarn       logThrottle // refusals by acl or token
+
+	listenerMutex sync.Mutex
+	listeners     []Listener
+	draining      int32         // atomic
+	drained       chan struct{} // closed when drain completes
+}
+
+func (ss *SCPServer) AcquireID() int {
+	return ss.idAllocator.AcquireID()
+}
+
+func (ss *SCPServer) ReleaseID(id int) {
+	ss.idAllocator.ReleaseID(id)
+}
+
+func (ss *SCPServer) QueryByID(id int) *scp.Conn {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	pair := ss.connPairs[id]
+	if pair != nil {
+		return pair.RemoteConn.RawConn()
+	}
+	return nil
+}
+
+func (ss *SCPServer) NumOfConnPairs() int {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	return len(ss.connPairs)
+}
+
+// PairSnapshot is a consistent count of sessions
+type PairSnapshot struct {
+	Total        int            `json:"total"`         // sessions dialing a backend included
+	ByHost       map[string]int `json:"by_host"`       // by name of the host serving them, addr if unnamed
+	Reuses       int64          `json:"reuses"`        // reconnections served
+	DialFailures int64          `json:"dial_failures"` // sessions closed as no backend was connected
+}
+
+// pairHost is the bucket of sessions on host in PairSnapshot
+func pairHost(host *Host) string {
+	if host.Name == "" {
+		return host.addr.String()
+	}
+	return host.Name
+}
+
+// Pairs returns the session counts taken under one lock, the cost is by
+// hosts rather than sessions
+func (ss *SCPServer) Pairs() *PairSnapshot {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	snapshot := &PairSnapshot{
+		Total:        len(ss.connPairs),
+		ByHost:       make(map[string]int, len(ss.pairsByHost)),
+		Reuses:       ss.reuses,
+		DialFailures: ss.dialFailures,
+	}
+	for name, n := range ss.pairsByHost {
+		snapshot.ByHost[name] = n
+	}
+	return snapshot
+}
+
+// SentCacheMemory returns sent cache bytes of sessions by transport
+func (ss *SCPServer) SentCacheMemory() map[string]int {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	memory := make(map[string]int)
+	for _, pair := range ss.connPairs {
+		memory[pair.network] += pair.RemoteConn.RawConn().SentCacheSize()
+	}
+	return memory
+}
+
+func (ss *SCPServer) NumOfGoroutineRejected() int64 {
+	return atomic.LoadInt64(&ss.goroutineRejected)
+}
+
+func (ss *SCPServer) NumOfClientRejected() int64 {
+	return atomic.LoadInt64(&ss.clientRejected)
+}
+
+func (ss *SCPServer) NumOfACLDenied() int64 {
+	return atomic.LoadInt64(&ss.aclDenied)
+}
+
+func (ss *SCPServer) NumOfTokenRejected() int64 {
+	return atomic.LoadInt64(&ss.tokenRejected)
+}
+
+func (ss *SCPServer) NumOfFamilyMismatches() int64 {
+	return atomic.LoadInt64(&ss.familyMismatches)
+}
+
+func (ss *SCPServer) NumOfFlappingSessions() int64 {
+	return atomic.LoadInt64(&ss.flappingSessions)
+}
+
+func (ss *SCPServer) NumOfCrossIPRejected() int64 {
+	return atomic.LoadInt64(&ss.crossIPRejected)
+}
+
+func (ss *SCPServer) NumOfConnsRejected() int64 {
+	return atomic.LoadInt64(&ss.connsRejected)
+}
+
+func (ss *SCPServer) NumOfIdleReaped() int64 {
+	return atomic.LoadInt64(&ss.idleReaped)
+}
+
+func (ss *SCPServer) NumOfHandshakeRetries() int64 {
+	return atomic.LoadInt64(&ss.handshakeRetries)
+}
+
+// sampleRelays periodically records state of every relay, a cheap view of
+// where relay time goes
+func (ss *SCPServer) sampleRelays(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ss.drained:
+			return
+		}
+		ss.connPairMutex.Lock()
+		for _, pair := range ss.connPairs {
+			atomic.AddInt64(&ss.downloadSamples[atomic.LoadInt32(&pair.download.state)], 1)
+			atomic.AddInt64(&ss.uploadSamples[atomic.LoadInt32(&pair.upload.state)], 1)
+		}
+		ss.connPairMutex.Unlock()
+	}
+}
+
+// reapIdle periodically closes sessions relaying no bytes in either direction
+// for timeout, sessions waiting for reuse are left to reuseTimeout
+func (ss *SCPServer) reapIdle(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ss.drained:
+			return
+		}
+		for _, pair := range ss.idlePairs(time.Now(), timeout) {
+			atomic.AddInt64(&ss.idleReaped, 1)
+			pair.log.Info("%s terminate, idle for %v", pair.tag, timeout)
+			ss.closePair(pair)
+		}
+	}
+}
+
+// idlePairs returns sessions idle for timeout at now
+func (ss *SCPServer) idlePairs(now time.Time, timeout time.Duration) []*ConnPair {
+	var idle []*ConnPair
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	for _, pair := range ss.connPairs {
+		if pair.LocalConn == nil { // still dialing
+			continue
+		}
+		n := atomic.LoadInt64(&pair.download.relayed) + atomic.LoadInt64(&pair.upload.relayed)
+		if pair.idleSince.IsZero() || n != pair.idleBytes || pair.RemoteConn.waitingReuse() {
+			pair.idleBytes, pair.idleSince = n, now
+			continue
+		}
+		if now.Sub(pair.idleSince) >= timeout {
+			idle = append(idle, pair)
+		}
+	}
+	return idle
+}
+
+// AcceptQueue returns new sessions waiting for global accept rate and their total delay
+func (ss *SCPServer) AcceptQueue() (int64, time.Duration) {
+	if ss.acceptBucket == nil {
+		return 0, 0
+	}
+	return ss.acceptBucket.Waiting(), ss.acceptBucket.Delayed()
+}
+
+// NumOfAcceptRejected returns new sessions rejected for waiting longer than
+// the global accept max delay
+func (ss *SCPServer) NumOfAcceptRejected() int64 {
+	if ss.acceptBucket == nil {
+		return 0
+	}
+	return ss.acceptBucket.NumOfRejected()
+}
+
+// RelaySamples returns sampled relay states, e.g. "download.read"
+func (ss *SCPServer) RelaySamples() map[string]int64 {
+	samples := make(map[string]int64)
+	for i, name := range relayStateNames {
+		samples["download."+name] = atomic.LoadInt64(&ss.downloadSamples[i])
+		samples["upload."+name] = atomic.LoadInt64(&ss.uploadSamples[i])
+	}
+	return samples
+}
+
+func (ss *SCPServer) CloseByID(id int) *scp.Conn {
+	pair := ss.GetConnPair(id)
+
+	if pair != nil {
+		pair.RemoteConn.CloseForReuse()
+		return pair.RemoteConn.RawConn()
+	}
+	return nil
+}
+
+// CloseByHosts terminates sessions on hosts of keys
+func (ss *SCPServer) CloseByHosts(keys map[string]bool) {
+	var pairs []*ConnPair
+	ss.connPairMutex.Lock()
+	for _, pair := range ss.connPairs {
+		if pair.LocalConn != nil && keys[pair.host.key()] {
+			pairs = append(pairs, pair)
+		}
+	}
+	ss.connPairMutex.Unlock()
+
+	for _, pair := range pairs {
+		pair.log.Info("%s terminate, host %s removed", pair.tag, pair.host.key())
+		pair.LocalConn.Close()
+		pair.RemoteConn.Close()
+	}
+	Log("terminate %d sessions on %d removed hosts", len(pairs), len(keys))
+}
+
+func (ss *SCPServer) IsDraining() bool {
+	return atomic.LoadInt32(&ss.draining) != 0
+}
+
+// Shutdown stops accepting connections and waits for sessions to finish until
+// ctx is done, remaining sessions are closed then and ctx.Err() is returned.
+// The provider is closed as well.
+func (ss *SCPServer) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&ss.draining, 0, 1) {
+		select {
+		case <-ss.drained:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer close(ss.drained)
+	defer ss.provider.Close()
+
+	ss.listenerMutex.Lock()
+	for _, ln := range ss.listeners {
+		ln.Close() // listeners shared by accept loops may be closed twice
+	}
+	ss.listenerMutex.Unlock()
+
+	Log("draining %d sessions", ss.NumOfConnPairs())
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+wait:
+	for ss.NumOfConnPairs() > 0 {
+		// clients can't reconnect any more
+		for _, pair := range ss.pairs() {
+			if pair.RemoteConn.waitingReuse() {
+				pair.log.Info("%s terminate, client gone while draining", pair.tag)
+				ss.closePair(pair)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		}
+	}
+
+	pairs := ss.pairs()
+	for _, pair := range pairs {
+		pair.log.Info("%s terminate, drain timeout", pair.tag)
+		ss.closePair(pair)
+	}
+	Log("drained, %d sessions terminated", len(pairs))
+	return err
+}
+
+// Reload reloads config file of the provider
+func (ss *SCPServer) Reload() error {
+	return ss.provider.Reload()
+}
+
+// Provider returns the provider of backend connections
+func (ss *SCPServer) Provider() *LocalConnProvider {
+	return ss.provider
+}
+
+// Subscribe returns a channel of session events buffered by size, events are
+// dropped if it's full
+func (ss *SCPServer) Subscribe(size int) chan *SessionEvent {
+	return ss.events.Subscribe(size)
+}
+
+func (ss *SCPServer) Unsubscribe(ch chan *SessionEvent) {
+	ss.events.Unsubscribe(ch)
+}
+
+func (ss *SCPServer) pairs() []*ConnPair {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	pairs := make([]*ConnPair, 0, len(ss.connPairs))
+	for _, pair := range ss.connPairs {
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+func (ss *SCPServer) closePair(pair *ConnPair) {
+	ss.connPairMutex.Lock()
+	localConn := pair.LocalConn
+	ss.connPairMutex.Unlock()
+	if localConn != nil {
+		localConn.Close()
+	}
+	pair.RemoteConn.Close()
+}
+
+func (ss *SCPServer) AddConnPair(id int, pair *ConnPair) {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	if _, ok := ss.connPairs[id]; ok {
+		Panic("ConnPair conflict: id<%d>", id)
+	}
+	ss.connPairs[id] = pair
+}
+
+func (ss *SCPServer) RemoveConnPair(id int) {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	if pair := ss.connPairs[id]; pair != nil && pair.host != nil {
+		name := pairHost(pair.host)
+		if ss.pairsByHost[name]--; ss.pairsByHost[name] <= 0 {
+			delete(ss.pairsByHost, name)
+		}
+	}
+	delete(ss.connPairs, id)
+}
+
+func (ss *SCPServer) GetConnPair(id int) *ConnPair {
+	ss.connPairMutex.Lock()
+	defer ss.connPairMutex.Unlock()
+	return ss.connPairs[id]
+}
+
+// sessionID identifies a session across instances
+func (ss *SCPServer) sessionID(id int) string {
+	if ss.options.Instance == "" {
+		return strconv.Itoa(id)
+	}
+	return ss.options.Instance + ":" + strconv.Itoa(id)
+}
+
+// emit publishes a lifecycle event of pair if anyone is listening
+func (ss *SCPServer) emit(typ string, pair *ConnPair, reason string) {
+	if !ss.events.Active() {
+		return
+	}
+	e := &SessionEvent{
+		Time:    time.Now(),
+		Type:    typ,
+		ID:      pair.RemoteConn.ID(),
+		Session: ss.sessionID(pair.RemoteConn.ID()),
+		Remote:  pair.RemoteConn.RemoteAddr().String(),
+		Reason:  reason,
+	}
+	if pair.host != nil {
+		e.Host = pair.host.Name
+	}
+	ss.events.Publish(e)
+}
+
+// allowReuse checks reconnection of oldConn from remote against reconnectIP policy
+func (ss *SCPServer) allowReuse(oldConn *scp.Conn, remote net.Addr) bool {
+	if ss.options.ReconnectIP == ReconnectIPAny {
+		return true
+	}
+	oldIP := net.ParseIP(addrIP(oldConn.RemoteAddr()))
+	newIP := net.ParseIP(addrIP(remote))
+	if oldIP == nil || newIP == nil {
+		return true
+	}
+	bits := 8 * net.IPv6len
+	if oldIP.To4() != nil && newIP.To4() != nil {
+		oldIP, newIP = oldIP.To4(), newIP.To4()
+		bits = 8 * net.IPv4len
+	}
+	ones := bits
+	if ss.options.ReconnectIP == ReconnectIPSubnet {
+		ones = ss.options.ReconnectSubnet
+		if bits == 8*net.IPv6len {
+			ones = ss.options.ReconnectSubnet6
+		}
+	}
+	mask := net.CIDRMask(ones, bits)
+	if len(oldIP) == len(newIP) && oldIP.Mask(mask).Equal(newIP.Mask(mask)) {
+		return true
+	}
+	atomic.AddInt64(&ss.crossIPRejected, 1)
+	log := newConnLogger(LogField{"session", ss.sessionID(oldConn.ID())}, LogField{"remote", remote.String()})
+	log.Log("<%s> reconnect rejected by reconnectIP policy %s, from %s, last %s", ss.sessionID(oldConn.ID()), ss.options.ReconnectIP, newIP, oldIP)
+	return false
+}
+
+// checkFamily records client and backend address family of pair, flags mismatches
+func (ss *SCPServer) checkFamily(pair *ConnPair) {
+	if pair.LocalConn == nil { // still dialing
+		return
+	}
+	client := addrFamily(pair.RemoteConn.RemoteAddr())
+	backend := addrFamily(pair.LocalConn.RemoteAddr())
+	if client == backend {
+		pair.log.Debug("%s address family: client %s, backend %s", pair.tag, client, backend)
+		return
+	}
+	atomic.AddInt64(&ss.familyMismatches, 1)
+	pair.log.Debug("%s address family mismatch: client %s(%s), backend %s(%s)", pair.tag,
+		client, pair.RemoteConn.RemoteAddr(), backend, pair.LocalConn.RemoteAddr())
+}
+
+func (ss *SCPServer) onReusedConn(scon *scp.Conn) {
+	id := scon.ID()
+	pair := ss.GetConnPair(id)
+
+	if pair != nil {
+		pair.Reuse(scon)
+		ss.connPairMutex.Lock()
+		ss.reuses++
+		ss.connPairMutex.Unlock()
+		ss.metrics.addReuse()
+		ss.checkFamily(pair)
+		if pair.reuses == ss.options.ReconnectWarn {
+			atomic.AddInt64(&ss.flappingSessions, 1)
+			host := ""
+			if pair.host != nil {
+				host = pair.host.Name
+			}
+			pair.log.with(LogField{"remote", scon.RemoteAddr().String()}).Log("%s reconnected %d times, client: %s, host: %s", pair.tag, pair.reuses, addrIP(scon.RemoteAddr()), host)
+		}
+		ss.emit(EventReconnect, pair, "")
+	}
+}
+
+func (ss *SCPServer) onNewConn(scon *scp.Conn, network string, log *connLogger) {
+	id := scon.ID()
+	defer ss.ReleaseID(id)
+
+	r := relay{
+		writeTimeout: time.Duration(ss.options.WriteTimeout) * time.Second,
+		maxFrame:     ss.options.MaxFrame,
+		splitFrame:   ss.options.SplitFrame,
+		sampling:     ss.options.SampleInterval > 0,
+	}
+	connPair := &ConnPair{
+		tag:      "<" + ss.sessionID(id) + ">",
+		log:      log,
+		network:  network,
+		download: r,
+		upload:   r,
+	}
+	connPair.RemoteConn = NewSCPConn(scon, ss.reuseTimeout)
+	// hold conn pair for reuse
+	ss.AddConnPair(id, connPair)
+	defer ss.RemoveConnPair(id)
+
+	localConn, host, err := ss.provider.createLocalConn(scon, log)
+	if err != nil {
+		ss.connPairMutex.Lock()
+		ss.dialFailures++
+		ss.connPairMutex.Unlock()
+		scon.Close()
+		log.Error("create local connnection failed: %s", err.Error())
+		ss.emit(EventClose, connPair, "create local connection failed: "+err.Error())
+		return
+	}
+
+	ss.connPairMutex.Lock()
+	connPair.LocalConn = localConn
+	connPair.host = host
+	// weighted sessions are counted on the chosen host, not the target
+	ss.pairsByHost[pairHost(host)]++
+	if !backendFields() {
+		connPair.tag += host.labels
+	}
+	minPacket, maxDelay := host.uploadBatching(ss.options.UploadMinPacket, ss.options.UploadMaxDelay)
+	connPair.upload.minPacket = minPacket
+	connPair.upload.maxDelay = time.Duration(maxDelay) * time.Millisecond
+	connPair.log = log.with(append([]LogField{{"host", host.Name}, {"backend", host.addr.String()}}, host.labelFields...)...)
+	if hm := ss.metrics.host(host.Name); hm != nil {
+		connPair.download.bytes = &hm.download
+		connPair.upload.bytes = &hm.upload
+	}
+	ss.connPairMutex.Unlock()
+	ss.checkFamily(connPair)
+	defer host.state.releaseConn()
+	ss.emit(EventOpen, connPair, "")
+	reason := connPair.Pump()
+	ss.emit(EventClose, connPair, reason)
+}
+
+// overGoroutineLimit is a safety valve against goroutine leaks or floods
+func (ss *SCPServer) overGoroutineLimit() bool {
+	max := ss.options.MaxGoroutines
+	if max <= 0 {
+		return false
+	}
+	n := runtime.NumGoroutine()
+	if n <= max {
+		return false
+	}
+	atomic.AddInt64(&ss.goroutineRejected, 1)
+	if ok, suppressed := ss.goroutineWarn.Allow(); ok {
+		Log("goroutines %d exceed limit %d, refuse new connections (suppressed %d warnings), check for goroutine leak", n, max, suppressed)
+	}
+	return true
+}
+
+func (ss *SCPServer) handleClient(c Conn, network string) {
+	defer Recover()
+	conn := c.GetConn()
+	log := newConnLogger(LogField{"network", network}, LogField{"remote", conn.RemoteAddr().String()})
+	scon := scp.Server(conn, &scp.Config{
+		ScpServer:     ss,
+		SentCacheSize: ss.options.transport(network).SentCacheSize,
+		SentCacheMin:  ss.options.SentCacheMin,
+		SentCacheMax:  ss.options.SentCacheMax,
+		Token:         ss.provider.token(),
+		AllowReuse:    ss.allowReuse,
+
+		HandshakeTimeout: time.Duration(ss.options.HandshakeTimeout) * time.Second,
+		HandshakeRetries: ss.options.HandshakeRetries,
+	})
+	err := scon.Handshake()
+	if n := scon.HandshakeRetries(); n > 0 {
+		atomic.AddInt64(&ss.handshakeRetries, int64(n))
+		log.Debug("handshake [%s] retried %d times", conn.RemoteAddr().String(), n)
+	}
+	if err == scp.ErrTokenMismatch {
+		atomic.AddInt64(&ss.tokenRejected, 1)
+		if ok, suppressed := ss.aclWarn.Allow(); ok {
+			log.Log("refuse client %s by token mismatch (suppressed %d warnings)", conn.RemoteAddr(), suppressed)
+		}
+		conn.Close()
+		return
+	}
+	if err != nil {
+		log.Error("handshake error [%s]: %s", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	c.SetOptions(ss.options)
+	log = log.with(LogField{"session", ss.sessionID(scon.ID())})
+
+	if scon.IsReused() {
+		ss.onReusedConn(scon)
+	} else {
+		// only new sessions count, reconnections must resume during bursts.
+		// sessions are delayed before taking a maxConns slot, so a queue of
+		// waiters doesn't hold slots
+		if ss.acceptBucket != nil {
+			delay, ok := ss.acceptBucket.Wait()
+			if !ok {
+				log.Debug("<%s> new session rejected by global accept rate", ss.sessionID(scon.ID()))
+				scon.Close()
+				ss.ReleaseID(scon.ID())
+				return
+			}
+			if delay > 0 {
+				log.Debug("<%s> new session delayed %v by global accept rate", ss.sessionID(scon.ID()), delay)
+			}
+		}
+		if !ss.acquireConn() {
+			scon.Close()
+			ss.ReleaseID(scon.ID())
+			return
+		}
+		defer atomic.AddInt64(&ss.conns, -1)
+		ss.onNewConn(scon, network, log)
+	}
+}
+
+// acquireConn counts a new session against maxConns
+func (ss *SCPServer) acquireConn() bool {
+	n := atomic.AddInt64(&ss.conns, 1)
+	max := ss.options.MaxConns
+	if max <= 0 || n <= int64(max) {
+		return true
+	}
+	atomic.AddInt64(&ss.conns, -1)
+	atomic.AddInt64(&ss.connsRejected, 1)
+	if ok, suppressed := ss.maxConnsWarn.Allow(); ok {
+		Log("sessions reach maxConns %d, refuse new sessions (suppressed %d warnings)", max, suppressed)
+	}
+	return false
+}
+
+// Start process connections
+func (ss *SCPServer) Start(network, laddr string) error {
+	loops := ss.options.AcceptLoops
+	if loops < 1 {
+		loops = 1
+	}
+	lns, err := listenLoops(network, laddr, ss.options, loops)
+	if err != nil {
+		return err
+	}
+
+	Info("scpServer listen: %s: %s, accept loops: %d", network, laddr, loops)
+	if loops == 1 && !ss.options.AcceptAffinity {
+		return ss.Serve(network, lns[0])
+	}
+
+	errc := make(chan error, loops)
+	for i, ln := range lns {
+		go func(i int, ln Listener) {
+			if ss.options.AcceptAffinity {
+				runtime.LockOSThread()
+				cpu := i % runtime.NumCPU()
+				if err := setAffinity(cpu); err != nil {
+					Error("set affinity of accept loop %d to cpu %d failed: %s", i, cpu, err.Error())
+				}
+			}
+			errc <- ss.Serve(network, ln)
+		}(i, ln)
+	}
+	return <-errc
+}
+
+// Serve accepts connections of network on ln, returns after drain if ln is
+// closed by Drain
+func (ss *SCPServer) Serve(network string, ln Listener) error {
+	ss.listenerMutex.Lock()
+	ss.listeners = append(ss.listeners, ln)
+	ss.listenerMutex.Unlock()
+	if ss.IsDraining() {
+		ln.Close()
+	}
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ss.IsDraining() {
+				<-ss.drained
+				return nil
+			}
+			if opErr, ok := err.(*net.OpError); ok && opErr.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				Error("accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			Error("accept failed:%s", err.Error())
+			return err
+		}
+		tempDelay = 0
+		ss.metrics.addAccepted()
+		if ss.overGoroutineLimit() {
+			conn.GetConn().Close()
+			continue
+		}
+		if ip := addrIP(conn.GetConn().RemoteAddr()); !ss.clients.Allow(ip) {
+			atomic.AddInt64(&ss.clientRejected, 1)
+			Debug("refuse client %s by client list", ip)
+			conn.GetConn().Close()
+			continue
+		}
+		// reconnections are checked as well, a session can't be resumed
+		// from a network the policy refuses
+		if remote := conn.GetConn().RemoteAddr(); !ss.provider.allowClient(remote) {
+			atomic.AddInt64(&ss.aclDenied, 1)
+			if ok, suppressed := ss.aclWarn.Allow(); ok {
+				Log("refuse client %s by acl (suppressed %d warnings)", remote, suppressed)
+			}
+			conn.GetConn().Close()
+			continue
+		}
+		go ss.handleClient(conn, network)
+	}
+}
+
+// NewServer returns a server relaying sessions to backend hosts of provider,
+// the provider should be loaded and is owned by the server since then
+func NewServer(options *Options, provider *LocalConnProvider) *SCPServer {
+	ss := &SCPServer{
+		options:      options,
+		provider:     provider,
+		reuseTimeout: time.Duration(options.Timeout) * time.Second,
+		idAllocator:  scp.NewIDAllocator(1),
+		connPairs:    make(map[int]*ConnPair),
+		pairsByHost:  make(map[string]int),
+		clients:      newClientList(options.IPTableSize, options.IPTablePolicy),
+		events:       newEventHub(),
+		drained:      make(chan struct{}),
+		goroutineWarn: logThrottle{
+			interval: 10 * time.Second,
+		},
+		maxConnsWarn: logThrottle{
+			interval: 10 * time.Second,
+		},
+		aclWarn: logThrottle{
+			interval: 10 * time.Second,
+		},
+	}
+	if options.GlobalAcceptRate > 0 {
+		ss.acceptBucket = newLeakyBucket(options.GlobalAcceptRate, time.Duration(options.AcceptMaxDelay)*time.Millisecond)
+	}
+	if options.Metrics {
+		ss.metrics = newMetrics()
+		provider.metrics = ss.metrics
+	}
+	provider.onHostsRemoved = ss.CloseByHosts
+	if options.SampleInterval > 0 {
+		go ss.sampleRelays(time.Duration(options.SampleInterval) * time.Millisecond)
+	}
+	if options.IdleTimeout > 0 {
+		go ss.reapIdle(time.Duration(options.IdleTimeout) * time.Second)
+	}
+	return ss
+}
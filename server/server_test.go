@@ -0,0 +1,657 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ejoy/goscon/scp"
+)
+
+// endlessConn is a source that never runs out of data
+type endlessConn struct {
+	net.Conn
+}
+
+func (c endlessConn) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c endlessConn) CloseRead() error  { return nil }
+func (c endlessConn) CloseWrite() error { return nil }
+
+// countConn counts writes to it and discards the data
+type countConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+func (c *countConn) CloseRead() error  { return nil }
+func (c *countConn) CloseWrite() error { return nil }
+
+func TestUploadBatching(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	zero, min, delay := 0, 100, 1000
+	cases := []struct {
+		host   Host
+		writes int // -1 means one per backend write
+	}{
+		{Host{UploadMinPacket: &min, UploadMaxDelay: &delay}, 1},
+		{Host{}, 1}, // options batch
+		{Host{UploadMinPacket: &zero, UploadMaxDelay: &zero}, -1},
+		{Host{UploadMaxDelay: &zero}, -1},
+	}
+	for i, c := range cases {
+		minPacket, maxDelay := c.host.uploadBatching(100, 1000)
+		r := &relay{minPacket: minPacket, maxDelay: time.Duration(maxDelay) * time.Millisecond}
+
+		// the backend sends 10 small packets, then closes
+		go func() {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for j := 0; j < 10; j++ {
+				conn.Write(bytes.Repeat([]byte{'x'}, 10))
+				time.Sleep(20 * time.Millisecond)
+			}
+		}()
+		src, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dst := &countConn{}
+		ch := make(chan relayResult, 1)
+		uploadUntilClose(dst, src.(*net.TCPConn), ch, r)
+		src.Close()
+		result := <-ch
+		if result.written != 100 {
+			t.Fatalf("case %d: %d bytes relayed", i, result.written)
+		}
+		if c.writes > 0 && dst.writes != c.writes {
+			t.Errorf("case %d: %d writes, expected %d", i, dst.writes, c.writes)
+		}
+		if c.writes < 0 && dst.writes < 5 {
+			t.Errorf("case %d: %d writes, expected small writes relayed at once", i, dst.writes)
+		}
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// peer accepts but never drains its receive buffer
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		conn.(*net.TCPConn).SetReadBuffer(4096)
+		accepted <- conn
+	}()
+
+	dst, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	dst.SetWriteBuffer(4096)
+
+	peer := <-accepted
+	if peer == nil {
+		t.Fatal("accept failed")
+	}
+	defer peer.Close()
+
+	ch := make(chan relayResult, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- downloadUntilClose(dst, endlessConn{}, ch, &relay{writeTimeout: 100 * time.Millisecond})
+	}()
+
+	select {
+	case err := <-done:
+		if err != errWriteTimeout {
+			t.Fatalf("expected write timeout, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("relay not stopped by write timeout")
+	}
+
+	result := <-ch
+	if result.written <= 0 {
+		t.Errorf("nothing written before timeout")
+	}
+	if reason := closeReason("client", "backend", result.err); reason != "backend write timeout" {
+		t.Errorf("unexpected close reason: %s", reason)
+	}
+}
+
+func BenchmarkAcceptLoops(b *testing.B) {
+	for _, loops := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("loops=%d", loops), func(b *testing.B) {
+			benchmarkAccept(b, loops)
+		})
+	}
+}
+
+func benchmarkAccept(b *testing.B, loops int) {
+	lns, err := listenLoops("tcp", "127.0.0.1:0", &Options{}, loops)
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := lns[0].(tcpListener).ln.Addr().String()
+
+	var accepted int64
+	for _, ln := range lns {
+		go func(ln Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.GetConn().Close()
+				atomic.AddInt64(&accepted, 1)
+			}
+		}(ln)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0) // no TIME_WAIT to exhaust ports
+			conn.Close()
+		}
+	})
+	for atomic.LoadInt64(&accepted) < int64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+
+	closed := make(map[Listener]bool)
+	for _, ln := range lns {
+		if !closed[ln] {
+			ln.(tcpListener).ln.Close()
+			closed[ln] = true
+		}
+	}
+}
+
+// listenEcho serves an echo backend, returns its address
+func listenEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// writeConfigFile writes data to the config file
+func writeConfigFile(t *testing.T, config, data string) {
+	if err := os.WriteFile(config, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startEcho serves an echo backend and writes a config of it to a temp file
+func startEcho(t *testing.T) string {
+	config := filepath.Join(t.TempDir(), "settings.conf")
+	writeConfigFile(t, config, fmt.Sprintf(`{"hosts":[{"addr":"%s","weight":100,"name":"echo"}]}`, listenEcho(t)))
+	return config
+}
+
+// startTestServer serves hosts of config with options on a local tcp
+// address, the server is shut down when the test ends
+func startTestServer(t *testing.T, config string, options *Options) (*SCPServer, *LocalConnProvider, string) {
+	provider := NewLocalConnProvider(config)
+	if err := provider.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	ss := NewServer(options, provider)
+	ln, err := ListenWithOptions("tcp", "127.0.0.1:0", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ss.Serve("tcp", ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		ss.Shutdown(ctx)
+	})
+	return ss, provider, ln.Addr().String()
+}
+
+// dialSCP connects a scp client of config to addr, the raw conn is returned
+// to break the link under the client
+func dialSCP(t *testing.T, addr string, config *scp.Config) (net.Conn, *scp.Conn) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scon := scp.Client(conn, config)
+	scon.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, scon
+}
+
+// echo writes msg on conn and reads it back
+func echo(conn net.Conn, msg string) error {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("echo %q, expected %q", buf, msg)
+	}
+	return nil
+}
+
+func TestServersInProcess(t *testing.T) {
+	var servers []*SCPServer
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		ss, _, addr := startTestServer(t, startEcho(t), &Options{Timeout: 1})
+		servers = append(servers, ss)
+		addrs = append(addrs, addr)
+	}
+
+	for i, addr := range addrs {
+		_, scon := dialSCP(t, addr, &scp.Config{})
+		if err := echo(scon, fmt.Sprint("hello ", i)); err != nil {
+			t.Fatalf("server %d: %v", i, err)
+		}
+		scon.Close()
+	}
+
+	for i, ss := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		if err := ss.Shutdown(ctx); err != nil {
+			t.Errorf("server %d: shutdown: %v", i, err)
+		}
+		cancel()
+		if ss.NumOfConnPairs() != 0 {
+			t.Errorf("server %d: %d sessions after shutdown", i, ss.NumOfConnPairs())
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ss, _, addr := startTestServer(t, startEcho(t), &Options{Timeout: 10, IdleTimeout: 1})
+
+	// idle keeps its connection but stops sending, gone drops its connection
+	// and is waiting for reuse
+	_, idle := dialSCP(t, addr, &scp.Config{})
+	if err := echo(idle, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	gone, scon := dialSCP(t, addr, &scp.Config{})
+	if err := echo(scon, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	gone.Close()
+
+	// the reaper closes idle within timeout and a scan interval
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Fatal("idle session not closed")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := ss.NumOfIdleReaped(); n != 1 {
+		t.Errorf("%d sessions reaped, expected 1", n)
+	}
+	if n := ss.NumOfConnPairs(); n != 1 {
+		t.Errorf("%d sessions left, expected the one waiting for reuse", n)
+	}
+}
+
+func TestDrainNamedHost(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "settings.conf")
+	writeConfig := func(drain bool) {
+		writeConfigFile(t, config, fmt.Sprintf(`{"hosts":[{"addr":"%s","weight":100,"name":"echo"},{"addr":"%s","weight":0,"name":"standby","drain":%v}]}`,
+			listenEcho(t), listenEcho(t), drain))
+	}
+	writeConfig(false)
+	_, provider, addr := startTestServer(t, config, &Options{Timeout: 10})
+
+	standbyConns := func() int64 {
+		return provider.GetHostByName("standby").state.NumOfConns()
+	}
+
+	// weight 0 is reachable by name only
+	raw, pinned := dialSCP(t, addr, &scp.Config{TargetServer: "standby"})
+	if err := echo(pinned, "pinned"); err != nil {
+		t.Fatal(err)
+	}
+	if n := standbyConns(); n != 1 {
+		t.Fatalf("%d sessions on standby, expected 1", n)
+	}
+	for i := 0; i < 10; i++ {
+		_, scon := dialSCP(t, addr, &scp.Config{})
+		if err := echo(scon, "weighted"); err != nil {
+			t.Fatal(err)
+		}
+		scon.Close()
+	}
+	if n := standbyConns(); n != 1 {
+		t.Errorf("%d sessions on standby after weighted sessions", n)
+	}
+
+	// draining blocks new named sessions, the pinned one reconnects
+	writeConfig(true)
+	if err := provider.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if host := provider.GetHostByName("standby"); host == nil || host.Name != "echo" {
+		t.Errorf("draining standby selected: %v", host)
+	}
+	_, scon := dialSCP(t, addr, &scp.Config{TargetServer: "standby"})
+	if err := echo(scon, "new"); err != nil {
+		t.Fatal(err)
+	}
+	scon.Close()
+
+	raw.Close()
+	_, reused := dialSCP(t, addr, &scp.Config{ConnForReused: pinned})
+	if err := echo(reused, "reconnected"); err != nil {
+		t.Fatalf("reconnect to draining host: %v", err)
+	}
+	reused.Close()
+}
+
+func TestPairsByHost(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "settings.conf")
+	writeConfigFile(t, config, fmt.Sprintf(`{"hosts":[{"addr":"%s","weight":100,"name":"a"},{"addr":"%s","weight":0,"name":"b"}]}`,
+		listenEcho(t), listenEcho(t)))
+	ss, _, addr := startTestServer(t, config, &Options{Timeout: 1})
+
+	var sessions []*scp.Conn
+	for _, target := range []string{"", "", "b"} {
+		_, scon := dialSCP(t, addr, &scp.Config{TargetServer: target})
+		if err := echo(scon, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, scon)
+	}
+	_, missing := dialSCP(t, addr, &scp.Config{TargetServer: "missing"})
+	if err := echo(missing, "ping"); err == nil {
+		t.Fatal("session to missing host relayed")
+	}
+	raw, pinned := dialSCP(t, addr, &scp.Config{TargetServer: "b"})
+	if err := echo(pinned, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+	_, reused := dialSCP(t, addr, &scp.Config{ConnForReused: pinned})
+	if err := echo(reused, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	p := ss.Pairs()
+	if p.Total != 4 || p.ByHost["a"] != 2 || p.ByHost["b"] != 2 || len(p.ByHost) != 2 {
+		t.Errorf("pairs %d by host %v", p.Total, p.ByHost)
+	}
+	if p.Reuses != 1 || p.DialFailures != 1 {
+		t.Errorf("reuses %d, dial failures %d", p.Reuses, p.DialFailures)
+	}
+
+	// sessions gone past reuse timeout leave their hosts
+	for _, scon := range sessions {
+		scon.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ss.Pairs().ByHost["a"] != 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if p := ss.Pairs(); p.Total != 1 || len(p.ByHost) != 1 || p.ByHost["b"] != 1 {
+		t.Errorf("pairs %d by host %v after close", p.Total, p.ByHost)
+	}
+	reused.Close()
+}
+
+func TestAccessControl(t *testing.T) {
+	backend := listenEcho(t)
+	config := filepath.Join(t.TempDir(), "settings.conf")
+	writeConfig := func(acl string) {
+		writeConfigFile(t, config, fmt.Sprintf(`{"hosts":[{"addr":"%s","weight":100,"name":"echo"}]%s}`, backend, acl))
+	}
+	writeConfig(`,"allow":["127.0.0.0/8"],"token":"secret"`)
+	ss, provider, addr := startTestServer(t, config, &Options{Timeout: 10})
+
+	raw, scon := dialSCP(t, addr, &scp.Config{Token: "secret"})
+	if err := echo(scon, "allowed"); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "guess"} {
+		_, bad := dialSCP(t, addr, &scp.Config{Token: token})
+		if err := echo(bad, "ping"); err == nil {
+			t.Errorf("token %q accepted", token)
+		}
+	}
+	if n := ss.NumOfTokenRejected(); n != 2 {
+		t.Errorf("%d token rejected, expected 2", n)
+	}
+
+	// the reloaded policy refuses new sessions and reconnections, the
+	// established session stays
+	writeConfig(`,"deny":["127.0.0.1"]`)
+	if err := provider.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(scon, "established"); err != nil {
+		t.Fatalf("established session dropped by reload: %v", err)
+	}
+	_, denied := dialSCP(t, addr, &scp.Config{})
+	if err := echo(denied, "ping"); err == nil {
+		t.Error("denied client relayed")
+	}
+	raw.Close()
+	_, reused := dialSCP(t, addr, &scp.Config{ConnForReused: scon})
+	if err := echo(reused, "reconnected"); err == nil {
+		t.Error("denied client reconnected")
+	}
+	if n := ss.NumOfACLDenied(); n != 2 {
+		t.Errorf("%d acl denied, expected 2", n)
+	}
+
+	// invalid policy is refused as a whole
+	writeConfig(`,"allow":["127.0.0.0/33"]`)
+	if err := provider.Reload(); err == nil {
+		t.Error("invalid allow accepted")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestHostLabelsLogged(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "settings.conf")
+	writeConfigFile(t, config, fmt.Sprintf(`{"hosts":[{"addr":"%s","weight":100,"name":"echo","labels":{"zone":"a"}}]}`, listenEcho(t)))
+	defer SetLogBackend(backend)
+	defer SetLogLevel(logLevel)
+	SetLogLevel(2)
+
+	cases := []struct {
+		format string
+		tagged bool // labels in the tag of messages
+	}{
+		{LogFormatText, true},
+		{LogFormatJSON, false},
+	}
+	for i, c := range cases {
+		var buf syncBuffer
+		if c.format == LogFormatJSON {
+			SetLogBackend(&jsonBackend{w: &buf})
+		} else {
+			SetLogBackend(newTextBackend(&buf))
+		}
+
+		ss, _, addr := startTestServer(t, config, &Options{Timeout: 10})
+		_, scon := dialSCP(t, addr, &scp.Config{})
+		if err := echo(scon, "labels"); err != nil {
+			t.Fatal(err)
+		}
+		scon.Close()
+		// the session is logged by the time it is drained
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		ss.Shutdown(ctx)
+		cancel()
+
+		var pair string // the new pair message
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, "new pair") {
+				pair = line
+				break
+			}
+		}
+		if pair == "" {
+			t.Fatalf("case %d: no new pair in %s", i, buf.String())
+		}
+		if tagged := strings.Contains(pair, "{zone=a}"); tagged != c.tagged {
+			t.Errorf("case %d: labels in tag %v: %s", i, tagged, pair)
+		}
+		if c.format != LogFormatJSON {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(pair), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["label.zone"] != "a" || record["host"] != "echo" {
+			t.Errorf("case %d: record %s", i, pair)
+		}
+	}
+}
+
+func TestMaxFrame(t *testing.T) {
+	cases := []struct {
+		maxFrame int
+		split    bool
+		size     int // bytes of the frame
+		writes   int
+		err      error
+	}{
+		{0, false, 32 << 10, 1, nil},
+		{10, true, 10, 1, nil},
+		{10, true, 25, 3, nil},
+		{10, true, 30, 3, nil},
+		{10, false, 10, 1, nil},
+		{10, false, 11, 0, errFrameTooLarge},
+	}
+	for i, c := range cases {
+		r := &relay{maxFrame: c.maxFrame, splitFrame: c.split}
+		dst := &countConn{}
+		n, err := r.write(dst, make([]byte, c.size))
+		if err != c.err {
+			t.Errorf("case %d: %v, expected %v", i, err, c.err)
+		}
+		if dst.writes != c.writes {
+			t.Errorf("case %d: %d writes, expected %d", i, dst.writes, c.writes)
+		}
+		written := c.size
+		if c.err != nil {
+			written = 0
+		}
+		if n != written {
+			t.Errorf("case %d: %d bytes written, expected %d", i, n, written)
+		}
+		if r.relayed != int64(n) {
+			t.Errorf("case %d: %d bytes relayed, written %d", i, r.relayed, n)
+		}
+	}
+
+	// a session sending an oversized frame is closed with a distinct reason
+	r := &relay{maxFrame: 1024}
+	ch := make(chan relayResult, 1)
+	err := downloadUntilClose(&countConn{}, endlessConn{}, ch, r)
+	if err != errFrameTooLarge || (<-ch).written != 0 {
+		t.Errorf("relay of oversized frames: %v", err)
+	}
+	if reason := closeReason("client", "backend", err); reason != "client frame too large" {
+		t.Errorf("close reason %q", reason)
+	}
+}
+
+func TestGlobalAcceptRate(t *testing.T) {
+	// every session after the first of a second would be delayed, and is
+	// rejected before it takes a maxConns slot
+	ss, _, addr := startTestServer(t, startEcho(t), &Options{Timeout: 10, MaxConns: 1, GlobalAcceptRate: 1})
+	_, scon := dialSCP(t, addr, &scp.Config{})
+	if err := echo(scon, "admitted"); err != nil {
+		t.Fatal(err)
+	}
+	scon.Close()
+	for i := 0; i < 3; i++ {
+		_, burst := dialSCP(t, addr, &scp.Config{})
+		if err := echo(burst, "burst"); err == nil {
+			t.Errorf("burst session %d relayed", i)
+		}
+	}
+	if n := ss.NumOfAcceptRejected(); n != 3 {
+		t.Errorf("%d rejected, expected 3", n)
+	}
+	if n := ss.NumOfConnsRejected(); n != 0 {
+		t.Errorf("%d rejected by maxConns", n)
+	}
+}
@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const DSCPSupported = true
+
+const reuseportSupported = true
+
+const SockParamsSupported = true
+
+const BindDeviceSupported = true
+
+// SO_REUSEPORT is missing in syscall, this is the value of x86 and arm
+const soReuseport = 0xf
+
+// setDSCP marks ip packets of the socket with dscp
+func setDSCP(c syscall.RawConn, ipv6 bool, dscp int) error {
+	tos := dscp << 2
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if ipv6 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			if serr != nil {
+				return
+			}
+		}
+		// also for ipv4-mapped addresses on ipv6 socket, may fail on ipv6 only socket
+		if e := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos); !ipv6 {
+			serr = e
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setReuseport allows several sockets to listen on the same address,
+// the kernel balances incoming connections between them
+func setReuseport(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReuseport, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setAffinity binds the calling thread to cpu, the goroutine must be locked to its thread
+func setAffinity(cpu int) error {
+	var mask [1024 / 64]uint64
+	mask[cpu/64%len(mask)] |= 1 << uint(cpu%64)
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// getSockParams reads buffer sizes and nodelay of a tcp socket
+func getSockParams(c syscall.RawConn) (rcvbuf, sndbuf int, nodelay bool, err error) {
+	var serr error
+	err = c.Control(func(fd uintptr) {
+		if rcvbuf, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); serr != nil {
+			return
+		}
+		if sndbuf, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF); serr != nil {
+			return
+		}
+		var v int
+		if v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY); serr != nil {
+			return
+		}
+		nodelay = v != 0
+	})
+	if err == nil {
+		err = serr
+	}
+	// the kernel doubles the size set for bookkeeping and reports the doubled value
+	return rcvbuf / 2, sndbuf / 2, nodelay, err
+}
+
+// setSockBuffers sets buffer sizes of a socket, 0 means unchanged
+func setSockBuffers(c syscall.RawConn, rcvbuf, sndbuf int) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if rcvbuf > 0 {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); serr != nil {
+				return
+			}
+		}
+		if sndbuf > 0 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndbuf)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// bindToDevice binds the socket to a network interface with SO_BINDTODEVICE
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.BindToDevice(int(fd), iface)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
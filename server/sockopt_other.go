@@ -0,0 +1,45 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+const DSCPSupported = false
+
+const reuseportSupported = false
+
+const SockParamsSupported = false
+
+const BindDeviceSupported = false
+
+var errDSCPUnsupported = errors.New("dscp unsupported on this platform")
+var errAffinityUnsupported = errors.New("cpu affinity unsupported on this platform")
+var errSockParamsUnsupported = errors.New("socket parameters unsupported on this platform")
+
+func setDSCP(c syscall.RawConn, ipv6 bool, dscp int) error {
+	return errDSCPUnsupported
+}
+
+func setReuseport(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func setAffinity(cpu int) error {
+	return errAffinityUnsupported
+}
+
+func getSockParams(c syscall.RawConn) (rcvbuf, sndbuf int, nodelay bool, err error) {
+	return 0, 0, false, errSockParamsUnsupported
+}
+
+func setSockBuffers(c syscall.RawConn, rcvbuf, sndbuf int) error {
+	return errSockParamsUnsupported
+}
+
+func bindToDevice(c syscall.RawConn, iface string) error {
+	return ErrBindDeviceUnsupported
+}
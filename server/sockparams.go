@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// socket parameters which can be propagated from client to backend connections
+const (
+	propagateRcvbuf = 1 << iota
+	propagateSndbuf
+	propagateNodelay
+)
+
+var propagateNames = map[string]int{
+	"rcvbuf":  propagateRcvbuf,
+	"sndbuf":  propagateSndbuf,
+	"nodelay": propagateNodelay,
+}
+
+// ParsePropagate parses a comma separated list of propagateNames
+func ParsePropagate(s string) (int, error) {
+	mask := 0
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		v, ok := propagateNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown socket parameter: %s", name)
+		}
+		mask |= v
+	}
+	return mask, nil
+}
+
+// sockParams are parameters of a client tcp connection to apply on the backend connection
+type sockParams struct {
+	mask    int
+	rcvbuf  int
+	sndbuf  int
+	nodelay bool
+}
+
+// clientSockParams reads parameters in mask of client conn, nil if conn is not tcp
+func clientSockParams(conn net.Conn, mask int) (*sockParams, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, nil
+	}
+	c, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	p := &sockParams{mask: mask}
+	if p.rcvbuf, p.sndbuf, p.nodelay, err = getSockParams(c); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// control sets buffer sizes before connect, so window scaling is negotiated for them
+func (p *sockParams) control(c syscall.RawConn) error {
+	var rcvbuf, sndbuf int
+	if p.mask&propagateRcvbuf != 0 {
+		rcvbuf = p.rcvbuf
+	}
+	if p.mask&propagateSndbuf != 0 {
+		sndbuf = p.sndbuf
+	}
+	if rcvbuf == 0 && sndbuf == 0 {
+		return nil
+	}
+	return setSockBuffers(c, rcvbuf, sndbuf)
+}
+
+// apply sets parameters which are reset by net after connect
+func (p *sockParams) apply(conn *net.TCPConn) error {
+	if p.mask&propagateNodelay != 0 {
+		return conn.SetNoDelay(p.nodelay)
+	}
+	return nil
+}
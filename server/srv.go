@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func lookupSRV(name string) ([]*net.SRV, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	return records, err
+}
+
+// expandHosts replaces hosts with a srv name by the targets of the srv record,
+// SRV weight and priority are taken as host weight and priority
+func (tp *LocalConnProvider) expandHosts(config *Config) ([]Host, error) {
+	var hosts []Host
+	var problems []string
+	for _, host := range config.Hosts {
+		if host.Srv == "" {
+			hosts = append(hosts, host)
+			continue
+		}
+
+		lookup := tp.lookupSRV
+		if lookup == nil {
+			lookup = lookupSRV
+		}
+		records, err := lookup(host.Srv)
+		if err == nil && len(records) == 0 {
+			err = fmt.Errorf("lookup srv %s: no records", host.Srv)
+		}
+		if err != nil {
+			cached, ok := tp.srvCache[host.Srv]
+			if config.SrvStrict || !ok {
+				problems = append(problems, err.Error())
+				continue
+			}
+			Error("lookup srv %s failed, keep last known %d targets: %s", host.Srv, len(cached), err.Error())
+			records = cached
+		} else {
+			tp.srvCache[host.Srv] = records
+		}
+
+		for _, record := range records {
+			target := host
+			target.Srv = ""
+			target.Addr = net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+			target.Weight = int(record.Weight)
+			if target.Weight == 0 {
+				target.Weight = 1
+			}
+			target.Priority = int(record.Priority)
+			target.srv = host.Srv
+			hosts = append(hosts, target)
+		}
+		Info("srv %s resolved to %d targets", host.Srv, len(records))
+	}
+	if len(problems) > 0 {
+		return hosts, &ConfigError{Problems: problems}
+	}
+	return hosts, nil
+}
+
+func (tp *LocalConnProvider) hasSrv() bool {
+	for _, host := range tp.config.Hosts {
+		if host.Srv != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshSrv periodically re-resolves srv records of the running config
+func (tp *LocalConnProvider) refreshSrv() {
+	for {
+		tp.Lock()
+		config := tp.config
+		interval := time.Duration(config.SrvRefresh) * time.Second
+		enabled := interval > 0 && tp.hasSrv()
+		tp.Unlock()
+
+		if !enabled {
+			// check again later, a reload may enable it
+			if !tp.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+
+		if !tp.sleep(interval) {
+			return
+		}
+
+		if err := tp.refresh(config); err != nil {
+			Error("refresh srv failed: %s", err.Error())
+		}
+	}
+}
+
+// refresh re-resolves srv records of config if it is still running, a
+// reload meanwhile takes precedence
+func (tp *LocalConnProvider) refresh(config *Config) error {
+	tp.resetMutex.Lock()
+	defer tp.resetMutex.Unlock()
+	if tp.config != config {
+		return nil
+	}
+	return tp.resetLocked(config)
+}
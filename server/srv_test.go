@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"testing"
+)
+
+// stubResolver serves srv records from a map, missing names fail
+type stubResolver map[string][]*net.SRV
+
+func (r stubResolver) lookup(name string) ([]*net.SRV, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return records, nil
+}
+
+func hostAddrs(tp *LocalConnProvider) []string {
+	var addrs []string
+	for i := range tp.hosts {
+		addrs = append(addrs, tp.hosts[i].addr.String())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestSrvRefresh(t *testing.T) {
+	resolver := stubResolver{
+		"_game._tcp.test": {
+			{Target: "127.0.0.1.", Port: 2001, Priority: 0, Weight: 30},
+			{Target: "127.0.0.2.", Port: 2002, Priority: 0, Weight: 0},
+			{Target: "127.0.0.3.", Port: 2003, Priority: 1, Weight: 50},
+		},
+	}
+	tp := &LocalConnProvider{srvCache: make(map[string][]*net.SRV), lookupSRV: resolver.lookup}
+	config := &Config{Hosts: []Host{{Srv: "_game._tcp.test", Name: "game"}}, SrvRefresh: 10}
+	if err := tp.reset(config); err != nil {
+		t.Fatal(err)
+	}
+
+	weight := 0
+	for _, h := range tp.Snapshot().Hosts {
+		weight += h.EffectiveWeight
+	}
+	if len(tp.hosts) != 3 || weight != 31 {
+		t.Fatalf("hosts %v, weight %d", hostAddrs(tp), weight)
+	}
+	for i := 0; i < 20; i++ {
+		host := tp.GetHostByWeight()
+		if host == nil || host.Priority != 0 {
+			t.Fatalf("selected %v out of the lowest priority", host)
+		}
+	}
+	if host := tp.GetHostByName("game"); host == nil || host.srv != "_game._tcp.test" {
+		t.Errorf("selected %v by name", host)
+	}
+	state := tp.hosts[0].state
+
+	// a refresh swaps in the new targets, unchanged targets keep their state
+	resolver["_game._tcp.test"] = []*net.SRV{
+		{Target: "127.0.0.1.", Port: 2001, Weight: 30},
+		{Target: "127.0.0.4.", Port: 2004, Weight: 10},
+	}
+	if err := tp.refresh(config); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := hostAddrs(tp); len(addrs) != 2 || addrs[1] != "127.0.0.4:2004" {
+		t.Errorf("hosts %v after refresh", addrs)
+	}
+	if tp.hosts[0].state != state {
+		t.Errorf("state of unchanged target lost")
+	}
+
+	// failed or empty lookups keep the last good targets
+	delete(resolver, "_game._tcp.test")
+	if err := tp.refresh(config); err != nil {
+		t.Fatal(err)
+	}
+	resolver["_game._tcp.test"] = nil
+	if err := tp.refresh(config); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := hostAddrs(tp); len(addrs) != 2 {
+		t.Errorf("hosts %v after failed lookups", addrs)
+	}
+
+	// strict configs fail instead, the running pool is kept
+	config.SrvStrict = true
+	if err := tp.refresh(config); err == nil {
+		t.Error("strict refresh passed without records")
+	}
+	if addrs := hostAddrs(tp); len(addrs) != 2 {
+		t.Errorf("hosts %v after strict failure", addrs)
+	}
+
+	// refreshes of a config replaced by reload are dropped
+	reloaded := &Config{Hosts: []Host{{Addr: "127.0.0.9:2009", Name: "game", Weight: 1}}}
+	if err := tp.reset(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.refresh(config); err != nil || tp.config != reloaded {
+		t.Errorf("stale refresh applied, %v", err)
+	}
+}
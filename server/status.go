@@ -0,0 +1,92 @@
+package server
+
+import (
+	"runtime"
+	"time"
+)
+
+// StatusReport is the runtime status, logged on SIG_STATUS and served on /status
+type StatusReport struct {
+	Instance   string `json:"instance"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	CPUs       int    `json:"cpus"`
+	Goroutines int    `json:"goroutines"`
+	ConnPairs  int    `json:"conn_pairs"`
+	MaxConns   int    `json:"max_conns"` // 0 means no limit
+	Draining   bool   `json:"draining"`
+
+	GoroutineRejected int64 `json:"goroutine_rejected"`
+	ConnsRejected     int64 `json:"conns_rejected"`
+	IdleReaped        int64 `json:"idle_reaped"`
+	ACLDenied         int64 `json:"acl_denied"`
+	TokenRejected     int64 `json:"token_rejected"`
+	ClientRejected    int64 `json:"client_rejected"`
+	ClientList        int   `json:"client_list"`
+	ClientEvicted     int64 `json:"client_evicted"`
+	ClientRefused     int64 `json:"client_refused"`
+	EventsDropped     int64 `json:"events_dropped"`
+
+	SentCache         map[string]int     `json:"sent_cache"`
+	FamilyMismatches  int64              `json:"family_mismatches"`
+	FlappingSessions  int64              `json:"flapping_sessions"`
+	CrossIPRejected   int64              `json:"cross_ip_rejected"`
+	HandshakeRetries  int64              `json:"handshake_retries"`
+	RelaySamples      map[string]int64   `json:"relay_samples"`
+	AcceptQueue       int64              `json:"accept_queue"`
+	AcceptDelayed     time.Duration      `json:"accept_delayed"` // nanoseconds
+	AcceptRejected    int64              `json:"accept_rejected"`
+	DialFailureRatios map[string]float64 `json:"dial_failure_ratios"`
+	Health            map[string]string  `json:"health"`
+	HostsRejected     int64              `json:"hosts_rejected"`
+	DialRetries       int64              `json:"dial_retries"`
+	RateLimited       int64              `json:"rate_limited"`
+	LimitedIPs        int                `json:"limited_ips"`
+	LimitedIPsEvicted int64              `json:"limited_ips_evicted"`
+	LimitedIPsRefused int64              `json:"limited_ips_refused"`
+	PoolHits          int64              `json:"pool_hits"`
+
+	Pairs *PairSnapshot `json:"pairs"`
+}
+
+// Status collects the runtime status
+func (ss *SCPServer) Status() *StatusReport {
+	r := &StatusReport{
+		Instance:   ss.options.Instance,
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		CPUs:       runtime.NumCPU(),
+		Goroutines: runtime.NumGoroutine(),
+		MaxConns:   ss.options.MaxConns,
+		Draining:   ss.IsDraining(),
+
+		GoroutineRejected: ss.NumOfGoroutineRejected(),
+		ConnsRejected:     ss.NumOfConnsRejected(),
+		IdleReaped:        ss.NumOfIdleReaped(),
+		ACLDenied:         ss.NumOfACLDenied(),
+		TokenRejected:     ss.NumOfTokenRejected(),
+		ClientRejected:    ss.NumOfClientRejected(),
+		ClientList:        ss.clients.entries.Len(),
+		ClientEvicted:     ss.clients.entries.NumOfEvicted(),
+		ClientRefused:     ss.clients.entries.NumOfRefused(),
+		EventsDropped:     ss.events.NumOfDropped(),
+
+		SentCache:         ss.SentCacheMemory(),
+		FamilyMismatches:  ss.NumOfFamilyMismatches(),
+		FlappingSessions:  ss.NumOfFlappingSessions(),
+		CrossIPRejected:   ss.NumOfCrossIPRejected(),
+		HandshakeRetries:  ss.NumOfHandshakeRetries(),
+		RelaySamples:      ss.RelaySamples(),
+		DialFailureRatios: ss.provider.DialFailureRatios(),
+		Health:            ss.provider.Health(),
+		HostsRejected:     ss.provider.NumOfHostsRejected(),
+		DialRetries:       ss.provider.NumOfDialRetries(),
+		RateLimited:       ss.provider.NumOfRateLimited(),
+		PoolHits:          ss.provider.NumOfPoolHits(),
+		AcceptRejected:    ss.NumOfAcceptRejected(),
+
+		Pairs: ss.Pairs(),
+	}
+	r.ConnPairs = r.Pairs.Total
+	r.AcceptQueue, r.AcceptDelayed = ss.AcceptQueue()
+	r.LimitedIPs, r.LimitedIPsEvicted, r.LimitedIPsRefused = ss.provider.LimitedIPs()
+	return r
+}
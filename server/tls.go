@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// newTLSConfig returns tls config of host, the server name is Name of host,
+// or host part of Addr if Name is empty
+func newTLSConfig(host *Host) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host.Name,
+		InsecureSkipVerify: host.TLSSkipVerify,
+	}
+	if config.ServerName == "" {
+		if name, _, err := net.SplitHostPort(host.Addr); err == nil {
+			config.ServerName = name
+		}
+	}
+	if host.TLSCA != "" {
+		pem, err := os.ReadFile(host.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in tls_ca " + host.TLSCA)
+		}
+	}
+	return config, nil
+}
+
+// tlsConn is a tls backend connection, halves are closed on the tcp conn beneath
+type tlsConn struct {
+	*tls.Conn
+	tcp *net.TCPConn
+}
+
+func (c tlsConn) CloseRead() error {
+	return c.tcp.CloseRead()
+}
+
+// CloseWrite sends close_notify, then shuts down writing of the tcp conn
+func (c tlsConn) CloseWrite() error {
+	if err := c.Conn.CloseWrite(); err != nil {
+		return err
+	}
+	return c.tcp.CloseWrite()
+}
+
+// tlsClient runs tls handshake on conn within timeout, 0 means no timeout,
+// conn is closed if the handshake fails
+func tlsClient(conn *net.TCPConn, config *tls.Config, timeout time.Duration) (HalfCloseConn, error) {
+	c := tls.Client(conn, config)
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := c.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return tlsConn{Conn: c, tcp: conn}, nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startTLSEcho serves a tls echo backend with a self-signed certificate of
+// name, returns its address and the certificate file
+func startTLSEcho(t *testing.T, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String(), certFile
+}
+
+// prefixWrapper writes prefix to backends before relaying
+type prefixWrapper struct {
+	prefix []byte
+}
+
+func (w *prefixWrapper) Wrapper(local HalfCloseConn, remote net.Conn) (HalfCloseConn, error) {
+	_, err := local.Write(w.prefix)
+	return local, err
+}
+
+func TestTLSBackend(t *testing.T) {
+	addr, certFile := startTLSEcho(t, "backend.test")
+
+	cases := []struct {
+		host    Host
+		wrapper LocalConnWrapper
+		ok      bool
+	}{
+		{Host{Name: "backend.test", TLSCA: certFile}, nil, true},
+		{Host{Name: "other.test", TLSCA: certFile}, nil, false},
+		{Host{Name: "other.test", TLSSkipVerify: true}, nil, true},
+		{Host{Name: "backend.test"}, nil, false}, // not signed by system roots
+		{Host{Name: "backend.test", TLSCA: certFile}, &prefixWrapper{[]byte("hello")}, true},
+	}
+	for i, c := range cases {
+		host := c.host
+		host.Addr, host.Weight, host.TLS = addr, 10, true
+		tp := NewLocalConnProvider("")
+		if err := tp.reset(&Config{Hosts: []Host{host}, DialAttempts: 1, DialTimeoutMs: 3000}); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		tp.wrapper = c.wrapper
+
+		conn, _, err := tp.CreateLocalConn(remoteConnTo(host.Name))
+		if !c.ok {
+			if err == nil {
+				conn.Close()
+				t.Errorf("case %d: verification of %s passed", i, host.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		expected := "ping"
+		if w, ok := c.wrapper.(*prefixWrapper); ok {
+			expected = string(w.prefix) + expected
+		}
+		conn.Write([]byte("ping"))
+		conn.CloseWrite()
+		data, err := io.ReadAll(conn)
+		if err != nil || string(data) != expected {
+			t.Errorf("case %d: echo %q, %v", i, data, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// minimal server side websocket(RFC 6455), only enough to push text messages
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+)
+
+var errNotWebsocket = errors.New("not a websocket handshake")
+
+func headerContains(h http.Header, key, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		http.Error(w, errNotWebsocket.Error(), http.StatusBadRequest)
+		return nil, nil, errNotWebsocket
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return nil, nil, errNotWebsocket
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// writeWebsocketFrame writes a single unmasked frame
+func writeWebsocketFrame(w *bufio.Writer, opcode byte, payload []byte) error {
+	var header [10]byte
+	header[0] = 0x80 | opcode // FIN
+	n := 2
+	sz := len(payload)
+	switch {
+	case sz < 126:
+		header[1] = byte(sz)
+	case sz <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(sz))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(sz))
+		n += 8
+	}
+	if _, err := w.Write(header[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// discardWebsocketFrames consumes client frames until a close frame or an error
+func discardWebsocketFrames(r *bufio.Reader) error {
+	var header [2]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0f
+		sz := uint64(header[1] & 0x7f)
+		switch sz {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return err
+			}
+			sz = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return err
+			}
+			sz = binary.BigEndian.Uint64(ext[:])
+		}
+		if header[1]&0x80 != 0 { // mask key
+			sz += 4
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(sz)); err != nil {
+			return err
+		}
+		if opcode == wsOpClose {
+			return io.EOF
+		}
+	}
+}
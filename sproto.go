@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 
+	"github.com/ejoy/goscon/server"
 	"github.com/xjdrew/gosproto"
 )
 
@@ -27,7 +28,7 @@ type SprotoConnWrapper struct {
 	msgType int32
 }
 
-func (scw *SprotoConnWrapper) Wrapper(local *net.TCPConn, remote net.Conn) (*net.TCPConn, error) {
+func (scw *SprotoConnWrapper) Wrapper(local server.HalfCloseConn, remote net.Conn) (server.HalfCloseConn, error) {
 	aa := &sprotoAnnounceAddr{
 		RemoteAddr: remote.RemoteAddr().String(),
 		LocalAddr:  remote.LocalAddr().String(),
@@ -87,7 +88,7 @@ var optSprotoWrapper bool
 var optSprotoWrpperFormat string
 var optSprotoMessageType int
 
-func sprotoConnWrapperHook(provier *LocalConnProvider) {
+func sprotoConnWrapperHook(provier *server.LocalConnProvider) {
 	if !optSprotoWrapper {
 		return
 	}